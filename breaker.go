@@ -0,0 +1,140 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Circuit breaker for calls to the Ceph cluster.
+//
+// With the monitors unreachable every rbd command hangs until it times out, so
+// each Docker request would take minutes to fail. After --ceph-failures
+// connection failures or timeouts in a row the breaker opens: rbd and ceph
+// calls fail right away with a CephUnavailableError, while a background probe
+// checks on the cluster every --ceph-probe-interval and closes the breaker
+// once it responds. Kernel-only commands (rbd unmap, showmapped) always run.
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// how long the background probe waits for the cluster to answer
+	cephProbeTimeout = 30 * time.Second
+)
+
+// CephUnavailableError is returned, without calling the cluster, while the
+// circuit breaker is open
+type CephUnavailableError struct {
+	Since time.Time // when the breaker opened
+	Cause string    // the failure that opened it
+}
+
+func (e CephUnavailableError) Error() string {
+	return fmt.Sprintf("ceph unavailable since %s, failing fast until it responds again: %s", e.Since.UTC().Format(time.RFC3339), e.Cause)
+}
+
+// cephBreaker tracks the health of the cluster connection
+type cephBreaker struct {
+	m         sync.Mutex
+	failures  int       // connection failures or timeouts in a row
+	openSince time.Time // zero while closed
+	cause     string
+}
+
+func newCephBreaker() *cephBreaker {
+	return &cephBreaker{}
+}
+
+// allow returns a CephUnavailableError while the breaker is open
+func (b *cephBreaker) allow() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.openSince.IsZero() {
+		return nil
+	}
+	return CephUnavailableError{Since: b.openSince, Cause: b.cause}
+}
+
+// record counts the result of a cluster call, returns true if this opened the
+// breaker. Any answer from the cluster (even an error) closes it again.
+func (b *cephBreaker) record(err error) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if !isCephConnectionError(err) {
+		b.failures = 0
+		b.openSince = time.Time{}
+		return false
+	}
+	b.failures++
+	if *cephFailures <= 0 || b.failures < *cephFailures || !b.openSince.IsZero() {
+		return false
+	}
+	b.openSince = time.Now()
+	b.cause = err.Error()
+	return true
+}
+
+// isOpen tells if calls currently fail fast
+func (b *cephBreaker) isOpen() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return !b.openSince.IsZero()
+}
+
+// isCephConnectionError checks for a cluster call failing without an answer
+// from the cluster: killed after its timeout, or rbd/ceph giving up on the
+// monitors (ETIMEDOUT, ECONNREFUSED, "couldn't connect to the cluster")
+func isCephConnectionError(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case ShTimeoutError:
+		return true
+	case CmdError:
+		return e.ExitCode == int(syscall.ETIMEDOUT) ||
+			e.ExitCode == int(syscall.ECONNREFUSED) ||
+			strings.Contains(e.Stderr, "couldn't connect to the cluster")
+	}
+	return false
+}
+
+// isCephUnreachable tells if a cluster call failed for not reaching the
+// cluster, so it's worth trying again once it answers
+func isCephUnreachable(err error) bool {
+	kind := errorKindOf(err)
+	return kind == KindClusterUnavailable || kind == KindTimeout
+}
+
+// clusterSh calls rbd or ceph unless the breaker is open, and keeps track of
+// failures to reach the cluster
+func (d *cephRBDVolumeDriver) clusterSh(name string, args ...string) (string, error) {
+	if err := d.breaker.allow(); err != nil {
+		return "", err
+	}
+	out, err := d.sh(name, args...)
+	if d.breaker.record(err) {
+		log.Printf("ERROR: ceph unavailable after %d failures in a row, failing fast until it responds: %s", *cephFailures, err)
+		go d.probeCeph()
+	}
+	return out, err
+}
+
+// probeCeph checks on the cluster every --ceph-probe-interval until it
+// answers, then closes the breaker
+func (d *cephRBDVolumeDriver) probeCeph() {
+	for {
+		time.Sleep(*cephProbeInterval)
+		_, err := d.shWithTimeout(cephProbeTimeout, "rbd", d.rbdArgs(d.pool, "ls")...)
+		if !isCephConnectionError(err) {
+			d.breaker.record(err)
+			log.Printf("INFO: ceph responds again, no longer failing fast")
+			d.releasePendingUnlocks()
+			return
+		}
+		log.Printf("WARN: ceph still unavailable: %s", err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsCephConnectionError(t *testing.T) {
+	assert.False(t, isCephConnectionError(nil))
+	assert.False(t, isCephConnectionError(CmdError{ExitCode: 2}), "Expected ENOENT to be an answer")
+	assert.False(t, isCephConnectionError(errors.New("exec: not found")))
+	assert.True(t, isCephConnectionError(ShTimeoutError{Command: "rbd ls"}))
+	assert.True(t, isCephConnectionError(CmdError{ExitCode: 110}))
+	assert.True(t, isCephConnectionError(CmdError{ExitCode: 1, Stderr: "rbd: couldn't connect to the cluster!"}))
+}
+
+func TestCephBreaker(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer func(interval time.Duration) { *cephProbeInterval = interval }(*cephProbeInterval)
+	*cephProbeInterval = 10 * time.Millisecond
+
+	fake.addImage("rbd", "foo", "xfs")
+	fake.setDown(true)
+	for i := 0; i < *cephFailures; i++ {
+		_, err := d.Get(&volume.GetRequest{Name: "foo"})
+		assert.NotNil(t, err, "Expected Get to fail with the cluster down")
+	}
+	assert.True(t, d.breaker.isOpen(), "Expected breaker to open")
+
+	// fail fast, without calling rbd
+	calls := fake.countCalls("rbd")
+	_, err := d.Get(&volume.GetRequest{Name: "foo"})
+	if assert.NotNil(t, err, "Expected Get to fail fast") {
+		assert.Contains(t, err.Error(), "ceph unavailable")
+	}
+	assert.Equal(t, calls, fake.countCalls("rbd"), "Expected no rbd call")
+
+	// probe closes it once the cluster is back
+	fake.setDown(false)
+	for i := 0; i < 100 && d.breaker.isOpen(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, d.breaker.isOpen(), "Expected breaker to close")
+	_, err = d.Get(&volume.GetRequest{Name: "foo"})
+	assert.Nil(t, err, formatError("Get", err))
+}
+
+func TestCephBreaker_answersReset(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	fake.addImage("rbd", "foo", "xfs")
+	fake.setDown(true)
+	for i := 0; i < *cephFailures-1; i++ {
+		d.rbdImageExists("rbd", "foo")
+	}
+	fake.setDown(false)
+	// not found is an answer
+	exists, err := d.rbdImageExists("rbd", "bar")
+	assert.Nil(t, err, formatError("rbdImageExists", err))
+	assert.False(t, exists)
+
+	fake.setDown(true)
+	d.rbdImageExists("rbd", "foo")
+	assert.False(t, d.breaker.isOpen(), "Expected failures to be counted from the last answer")
+}
+
+func TestUnmount_cephUnavailable(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	fake.addImage("rbd", "foo", "xfs")
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+
+	// unmount and unmap only need the kernel
+	for i := 0; i < *cephFailures; i++ {
+		d.breaker.record(CmdError{ExitCode: 110})
+	}
+	assert.True(t, d.breaker.isOpen(), "Expected breaker to open")
+	err = d.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected unlock to fail fast")
+	assert.Equal(t, 0, len(fake.mounts), "Expected volume to be unmounted")
+	assert.Equal(t, 0, len(fake.mapped), "Expected volume to be unmapped")
+	_, found := d.getVolume(d.mountpoint("rbd", "foo"))
+	assert.False(t, found, "Expected volume not to be mounted anymore")
+	assert.Equal(t, 1, len(fake.image("rbd", "foo").locks), "Expected lock to be kept until the cluster answers")
+
+	// released once the probe sees the cluster again
+	d.breaker.record(nil)
+	d.releasePendingUnlocks()
+	assert.Equal(t, 0, len(fake.image("rbd", "foo").locks), "Expected lock to be released")
+	assert.Equal(t, 0, len(d.pendingUnlocks), "Expected nothing left to unlock")
+}
+
+func TestMount_releasesPendingUnlock(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	fake.addImage("rbd", "foo", "xfs")
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	for i := 0; i < *cephFailures; i++ {
+		d.breaker.record(CmdError{ExitCode: 110})
+	}
+	err = d.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected unlock to fail fast")
+
+	// kept across a restart, released by the next Mount
+	restarted := newCephRBDVolumeDriver("test", "", "admin", "rbd", filepath.Dir(d.stateFile), "", d.stateFile)
+	restarted.runner = fake
+	restarted.cookie = d.cookie
+	assert.Equal(t, 1, len(restarted.pendingUnlocks), "Expected pending unlock to be reloaded from state")
+	_, err = restarted.Mount(&volume.MountRequest{Name: "foo", ID: "c2"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, 1, fake.countCalls("rbd --pool rbd --conf  --id admin lock rm foo"), "Expected our old lock to be removed")
+	assert.Equal(t, 1, len(fake.image("rbd", "foo").locks), "Expected only our new lock")
+	assert.Equal(t, 0, len(restarted.pendingUnlocks), "Expected nothing left to unlock")
+}
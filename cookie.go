@@ -0,0 +1,162 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Lock cookies identify the host, boot and plugin instance holding an rbd
+// lock. A bare hostname is not unique (two hosts may share a name, a host may
+// be renamed while it has volumes mounted), so the cookie includes the
+// machine id and the boot id as well:
+//
+//	host=node1,machine=4f6c...,boot=0b1a-...,plugin=rbd,since=1697430000
+//
+// where since is when the lock was taken. Cookies of older plugin versions
+// are just the hostname.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cookie of locks taken through the exclusive-lock image feature
+const exclusiveLockCookiePrefix = "auto "
+
+var (
+	machineIDPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+	bootIDPath     = "/proc/sys/kernel/random/boot_id"
+)
+
+// lockCookie is the identity of a lock holder
+type lockCookie struct {
+	Host      string
+	MachineID string
+	BootID    string
+	Plugin    string
+	Since     time.Time // when the lock was taken, zero if unknown
+}
+
+// newLockCookie returns the identity of this host, boot and plugin instance
+func newLockCookie(pluginName string) lockCookie {
+	host, err := os.Hostname()
+	if err != nil {
+		log.Printf("WARN: HOST_UNKNOWN: unable to get hostname: %s", err)
+		host = "HOST_UNKNOWN"
+	}
+	machineID := ""
+	for _, path := range machineIDPaths {
+		if machineID = readIDFile(path); machineID != "" {
+			break
+		}
+	}
+	if machineID == "" {
+		log.Printf("WARN: unable to read machine id from %s, lock cookies only identify the host by name", strings.Join(machineIDPaths, " or "))
+	}
+	bootID := readIDFile(bootIDPath)
+	if bootID == "" {
+		log.Printf("WARN: unable to read boot id from %s", bootIDPath)
+	}
+	return lockCookie{Host: host, MachineID: machineID, BootID: bootID, Plugin: pluginName}
+}
+
+// readIDFile reads a one line id file, empty if missing
+func readIDFile(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// String renders the cookie as used for `rbd lock add`
+func (c lockCookie) String() string {
+	fields := []string{"host=" + c.Host}
+	if c.MachineID != "" {
+		fields = append(fields, "machine="+c.MachineID)
+	}
+	if c.BootID != "" {
+		fields = append(fields, "boot="+c.BootID)
+	}
+	if c.Plugin != "" {
+		fields = append(fields, "plugin="+c.Plugin)
+	}
+	if !c.Since.IsZero() {
+		fields = append(fields, "since="+strconv.FormatInt(c.Since.Unix(), 10))
+	}
+	return strings.Join(fields, ",")
+}
+
+// parseLockCookie parses a lock id, anything not in our key=value format
+// (e.g. cookies of older versions, or locks taken by hand) is taken as host name
+func parseLockCookie(cookie string) lockCookie {
+	if !strings.HasPrefix(cookie, "host=") {
+		return lockCookie{Host: cookie}
+	}
+	c := lockCookie{}
+	for _, field := range strings.Split(cookie, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return lockCookie{Host: cookie}
+		}
+		switch kv[0] {
+		case "host":
+			c.Host = kv[1]
+		case "machine":
+			c.MachineID = kv[1]
+		case "boot":
+			c.BootID = kv[1]
+		case "plugin":
+			c.Plugin = kv[1]
+		case "since":
+			if secs, err := strconv.ParseInt(kv[1], 10, 64); err == nil {
+				c.Since = time.Unix(secs, 0)
+			}
+		}
+	}
+	return c
+}
+
+// sameInstance is true if both cookies are from the same plugin instance on
+// the same machine and boot, whatever the hostname was at the time
+func (c lockCookie) sameInstance(other lockCookie) bool {
+	if c.MachineID == "" || c.BootID == "" {
+		// legacy cookie: all we have is the name
+		return c.Host == other.Host && other.MachineID == "" && other.BootID == ""
+	}
+	return c.MachineID == other.MachineID && c.BootID == other.BootID && c.Plugin == other.Plugin
+}
+
+// previousBoot is true if the other cookie is from this machine, but taken
+// before it last booted
+func (c lockCookie) previousBoot(other lockCookie) bool {
+	return c.MachineID != "" && c.BootID != "" && other.BootID != "" &&
+		c.MachineID == other.MachineID && c.BootID != other.BootID
+}
+
+// describe is a human readable form of the holder for logs and errors
+func (c lockCookie) describe() string {
+	if c.MachineID == "" && c.BootID == "" && c.Plugin == "" {
+		return fmt.Sprintf("host %s", c.Host)
+	}
+	return fmt.Sprintf("host %s (machine %s, boot %s), plugin %s", c.Host, c.MachineID, c.BootID, c.Plugin)
+}
+
+// describeLock describes who holds a lock, and since when if known:
+//
+//	host node1 (machine m1, boot b1), plugin rbd (client.4123 at 10.0.0.5:0/1234) since 2017-10-16T04:12:01Z
+func describeLock(lock rbdLock) string {
+	if strings.HasPrefix(lock.ID, exclusiveLockCookiePrefix) {
+		// managed by librbd or krbd, nothing to parse
+		return fmt.Sprintf("exclusive-lock owner (%s at %s)", lock.Locker, lock.Address)
+	}
+	c := parseLockCookie(lock.ID)
+	msg := fmt.Sprintf("%s (%s at %s)", c.describe(), lock.Locker, lock.Address)
+	if !c.Since.IsZero() {
+		msg += " since " + c.Since.UTC().Format(time.RFC3339)
+	}
+	return msg
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLockCookie(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-cookie")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "machine-id"), []byte("4f6c0d3b2a1e4c5d\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "boot_id"), []byte("0b1a2c3d-0000-1111-2222-333344445555\n"), 0644)
+	defer func(paths []string, boot string) { machineIDPaths, bootIDPath = paths, boot }(machineIDPaths, bootIDPath)
+	machineIDPaths = []string{filepath.Join(dir, "missing"), filepath.Join(dir, "machine-id")}
+	bootIDPath = filepath.Join(dir, "boot_id")
+
+	host, _ := os.Hostname()
+	cookie := newLockCookie("rbd")
+	assert.Equal(t, lockCookie{Host: host, MachineID: "4f6c0d3b2a1e4c5d", BootID: "0b1a2c3d-0000-1111-2222-333344445555", Plugin: "rbd"}, cookie)
+	assert.Equal(t, "host="+host+",machine=4f6c0d3b2a1e4c5d,boot=0b1a2c3d-0000-1111-2222-333344445555,plugin=rbd", cookie.String())
+	assert.Equal(t, cookie, parseLockCookie(cookie.String()))
+}
+
+func TestParseLockCookie_legacy(t *testing.T) {
+	// older versions used the bare hostname
+	c := parseLockCookie("node1")
+	assert.Equal(t, lockCookie{Host: "node1"}, c)
+	assert.Equal(t, "host node1", c.describe())
+	assert.True(t, c.sameInstance(lockCookie{Host: "node1"}))
+	assert.False(t, c.sameInstance(lockCookie{Host: "node10"}))
+}
+
+func TestLockCookie_sameInstance(t *testing.T) {
+	ours := lockCookie{Host: "node1", MachineID: "m1", BootID: "b1", Plugin: "rbd"}
+
+	renamed := ours
+	renamed.Host = "node2"
+	assert.True(t, ours.sameInstance(renamed), "Expected renamed host to be the same instance")
+
+	sameName := ours
+	sameName.MachineID = "m2"
+	assert.False(t, ours.sameInstance(sameName), "Expected other machine with same hostname to differ")
+
+	rebooted := ours
+	rebooted.BootID = "b2"
+	assert.False(t, ours.sameInstance(rebooted), "Expected lock from previous boot to differ")
+
+	otherPlugin := ours
+	otherPlugin.Plugin = "rbd2"
+	assert.False(t, ours.sameInstance(otherPlugin), "Expected other plugin instance to differ")
+
+	assert.Equal(t, "host node1 (machine m1, boot b1), plugin rbd", ours.describe())
+
+	// a lock taken by us at some time
+	taken := ours
+	taken.Since = time.Unix(1508127121, 0)
+	assert.Equal(t, "host=node1,machine=m1,boot=b1,plugin=rbd,since=1508127121", taken.String())
+	assert.Equal(t, taken, parseLockCookie(taken.String()))
+	assert.True(t, ours.sameInstance(parseLockCookie(taken.String())), "Expected lock time not to matter")
+	assert.Equal(t, "host node1 (machine m1, boot b1), plugin rbd (client.4123 at 10.0.0.5:0/1234) since 2017-10-16T04:12:01Z",
+		describeLock(rbdLock{ID: taken.String(), Locker: "client.4123", Address: "10.0.0.5:0/1234"}))
+}
+
+func TestLockCookie_previousBoot(t *testing.T) {
+	c := lockCookie{Host: "a", MachineID: "m1", BootID: "boot2"}
+	assert.True(t, c.previousBoot(lockCookie{Host: "b", MachineID: "m1", BootID: "boot1"}))
+	assert.False(t, c.previousBoot(lockCookie{MachineID: "m1", BootID: "boot2"}), "same boot")
+	assert.False(t, c.previousBoot(lockCookie{MachineID: "m2", BootID: "boot1"}), "other machine")
+	assert.False(t, c.previousBoot(lockCookie{Host: "a"}), "legacy cookie")
+}
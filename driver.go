@@ -28,24 +28,28 @@ package main
  */
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 )
 
 var (
-	imageNameRegexp    = regexp.MustCompile(`^(([-_.[:alnum:]]+)/)?([-_.[:alnum:]]+)(@([0-9]+))?$`) // optional pool or size in image name
-	rbdUnmapBusyRegexp = regexp.MustCompile(`^exit status 16$`)
+	imageNameRegexp = regexp.MustCompile(`^(([-_.[:alnum:]]+)/)?([-_.[:alnum:]]+)(@([0-9]+))?$`) // optional pool or size in image name
+
+	// polling for a lock held by another host, see lockImageWait
+	lockWaitInitialBackoff = time.Second
+	lockWaitMaxBackoff     = 15 * time.Second
 )
 
 // Volume is our local struct to store info about Ceph RBD Image
@@ -55,47 +59,85 @@ type Volume struct {
 	Locker string // track the lock name
 	FStype string
 	Pool   string
-	ID     string
+	// Docker mount IDs currently using the volume - only the first Mount maps
+	// and mounts it, only the last Unmount unmounts, unmaps and unlocks
+	MountIDs []string
+	LockMode string // lockModeExclusive, or advisory (also if empty, e.g. older state files)
+	ReadOnly bool   // shared read-only volume: mapped read-only, not locked
+	Client   string // our kernel client address, see kernelClient
 }
 
+// image lock modes, see --lock-mode
+const (
+	lockModeAdvisory  = "advisory"  // rbd lock add with our cookie
+	lockModeExclusive = "exclusive" // exclusive-lock image feature, held by the kernel client (rbd map -o exclusive)
+)
+
 // our driver type for impl func
 type cephRBDVolumeDriver struct {
 	// - using default ceph cluster name ("ceph")
 	// - using default ceph config (/etc/ceph/<cluster>.conf)
-	//
-	// TODO: when starting, what if there are mounts already for RBD devices?
-	// do we ingest them as our own or ... currently fails if locked
-	//
-	// TODO: use a chan as semaphore instead of mutex in driver?
-
-	name    string             // unique name for plugin
-	cluster string             // ceph cluster to use (default: ceph)
-	user    string             // ceph user to use (default: admin)
-	pool    string             // ceph pool to use (default: rbd)
-	root    string             // scratch dir for mounts for this plugin
-	config  string             // ceph config file to read
-	volumes map[string]*Volume // track locally mounted volumes, key on mountpoint
-	m       *sync.Mutex        // mutex to guard operations that change volume maps or use conn
+	// - devices already mapped and mounted at startup are adopted by reconcile()
+	// - API calls lock per pool/image, so slow calls (mkfs, xfs_repair) on one
+	//   volume don't block calls for other volumes
+
+	name      string             // unique name for plugin
+	cluster   string             // ceph cluster to use (default: ceph)
+	user      string             // ceph user to use (default: admin)
+	pool      string             // ceph pool to use (default: rbd)
+	root      string             // scratch dir for mounts for this plugin
+	config    string             // ceph config file to read
+	stateFile string             // persisted copy of volumes map (empty: don't persist)
+	volumes   map[string]*Volume // track locally mounted volumes, key on mountpoint
+	m         *sync.RWMutex      // guards volumes and pendingUnlocks maps and state file
+	locks     *volumeLocks       // serialize operations per pool/image
+	runner    commandRunner      // runs rbd and other external commands
+	cookie    lockCookie         // identifies our locks: host, machine, boot and plugin
+	breaker   *cephBreaker       // fail fast while the cluster is unreachable
+
+	staleLocks   *staleLocks // lock holders seen without watchers, see breakStaleLock
+	lockAuditLog string      // where broken locks are recorded (empty: only log them)
+	repairLogDir string      // where filesystem repair logs go, one per volume (empty: only log them)
+
+	// unmounted volumes whose lock release failed for the cluster being
+	// unreachable, key on mountpoint - see releasePendingUnlock
+	pendingUnlocks map[string]*Volume
+
+	localAddrs func() ([]string, error) // IP addresses of this host, never fenced
 }
 
-// newCephRBDVolumeDriver builds the driver struct, reads config file and connects to cluster
-func newCephRBDVolumeDriver(pluginName, cluster, userName, defaultPoolName, rootBase, config string) cephRBDVolumeDriver {
+// newCephRBDVolumeDriver builds the driver struct, reads config file and
+// loads any volumes we had mounted before a restart from the state file
+func newCephRBDVolumeDriver(pluginName, cluster, userName, defaultPoolName, rootBase, config, stateFile string) cephRBDVolumeDriver {
 	// the root mount dir will be based on docker default root and plugin name - pool added later per volume
 	mountDir := filepath.Join(rootBase, pluginName)
 	log.Printf("INFO: newCephRBDVolumeDriver: setting base mount dir=%s", mountDir)
 
 	// fill everything except the connection and context
 	driver := cephRBDVolumeDriver{
-		name:    pluginName,
-		cluster: cluster,
-		user:    userName,
-		pool:    defaultPoolName,
-		root:    mountDir,
-		config:  config,
-		volumes: map[string]*Volume{},
-		m:       &sync.Mutex{},
+		name:      pluginName,
+		cluster:   cluster,
+		user:      userName,
+		pool:      defaultPoolName,
+		root:      mountDir,
+		config:    config,
+		stateFile: stateFile,
+		volumes:   map[string]*Volume{},
+		m:         &sync.RWMutex{},
+		locks:     newVolumeLocks(),
+		runner:    shRunner{},
+		cookie:    newLockCookie(pluginName),
+		breaker:   newCephBreaker(),
+
+		staleLocks: newStaleLocks(),
+		localAddrs: localHostAddresses,
+
+		pendingUnlocks: map[string]*Volume{},
 	}
 
+	// pick up where we left off - otherwise we can't unmount/unlock after a restart
+	driver.loadState()
+
 	return driver
 }
 
@@ -121,9 +163,20 @@ func (d cephRBDVolumeDriver) Capabilities() *volume.CapabilitiesResponse {
 // --create option flag to be able to provision new RBD images.
 //
 // Docker Volume Create Options:
-//   size   - in MB
+//   size   - in MB, an existing image is grown to it (never shrunk), like
+//            with a bigger @size in the name
 //   pool
 //   fstype
+//   lock-wait - how long Mount waits for another host's lock (e.g. 30s),
+//               kept with the image
+//   access - rw (default) or ro: read-only, shared by any number of hosts,
+//            kept with the image
+//   fs-policy - what Mount does about filesystem errors: none, check, replay
+//               or auto-repair (default: --fs-policy), kept with the image
+//   mount-options - e.g. noatime,discard, added to the --mount-options
+//                   default on every Mount, kept with the image
+//   mkfs-options - e.g. "-i size=512 -L data", added to the --mkfs-options
+//                  default for new images, kept with the image
 //
 //
 // POST /VolumeDriver.Create
@@ -143,9 +196,6 @@ func (d cephRBDVolumeDriver) Capabilities() *volume.CapabilitiesResponse {
 //
 func (d cephRBDVolumeDriver) Create(r *volume.CreateRequest) error {
 	log.Printf("INFO: API Create(%q)", r)
-	d.m.Lock()
-	defer d.m.Unlock()
-
 	return d.createImage(r)
 }
 
@@ -158,9 +208,12 @@ func (d cephRBDVolumeDriver) createImage(r *volume.CreateRequest) error {
 	pool, name, size, err := d.parseImagePoolNameSize(r.Name)
 	if err != nil {
 		log.Printf("ERROR: parsing volume: %s", err)
-		return err
+		return newVolumeError(KindInvalidName, err, "Invalid volume name")
 	}
 
+	// only grow existing images to a size asked for, not the default
+	sizeGiven := nameHasSize(r.Name)
+
 	// Options to override from `docker volume create -o OPT=VAL ...`
 	if r.Options["pool"] != "" {
 		pool = r.Options["pool"]
@@ -170,38 +223,144 @@ func (d cephRBDVolumeDriver) createImage(r *volume.CreateRequest) error {
 		if err != nil {
 			log.Printf("WARN: using default size. unable to parse int from %s: %s", r.Options["size"], err)
 			size = *defaultImageSizeMB
+		} else {
+			sizeGiven = true
 		}
 	}
 	if r.Options["fstype"] != "" {
 		fstype = r.Options["fstype"]
 	}
+	if r.Options[metaLockWait] != "" {
+		_, err = time.ParseDuration(r.Options[metaLockWait])
+		if err != nil {
+			err = newVolumeError(KindInvalidOption, err, "Invalid %s option %q", metaLockWait, r.Options[metaLockWait])
+			log.Printf("ERROR: %s", err)
+			return err
+		}
+	}
+	mkfsOptions := parseMkfsOptions(r.Options[metaMkfsOptions])
+	if r.Options[metaMountOptions] != "" {
+		err = checkMountOptions(parseMountOptions(r.Options[metaMountOptions]))
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+			return err
+		}
+	}
+	if r.Options[metaFSPolicy] != "" && !contains(VALID_FS_POLICIES, r.Options[metaFSPolicy]) {
+		err = newVolumeError(KindInvalidOption, nil, "Invalid %s option %q, valid values are: %q", metaFSPolicy, r.Options[metaFSPolicy], VALID_FS_POLICIES)
+		log.Printf("ERROR: %s", err)
+		return err
+	}
+	if r.Options[metaAccess] != "" && !contains(VALID_ACCESS_MODES, r.Options[metaAccess]) {
+		err = newVolumeError(KindInvalidOption, nil, "Invalid %s option %q, valid values are: %q", metaAccess, r.Options[metaAccess], VALID_ACCESS_MODES)
+		log.Printf("ERROR: %s", err)
+		return err
+	}
+
+	unlock := d.locks.lock(pool, name)
+	defer unlock()
 
 	// check for mount
 	mount := d.mountpoint(pool, name)
 
-	// do we already know about this volume? return early
-	if _, found := d.volumes[mount]; found {
+	// do we already know about this volume? return early, unless it may need to grow
+	if _, found := d.getVolume(mount); found && !sizeGiven {
 		log.Println("INFO: Volume is already in known mounts: " + mount)
 		return nil
 	}
 
 	exists, err := d.rbdImageExists(pool, name)
 	if err != nil {
-		log.Printf("ERROR: checking for RBD Image: %s", err)
+		// don't know - could be cluster down, auth failure, etc: never assume it's gone
+		err = wrapVolumeError(err, "Unable to check for Ceph RBD Image(%s/%s)", pool, name)
+		log.Printf("ERROR: %s", err)
 		return err
 	}
+	if exists && len(mkfsOptions) > 0 {
+		// made with its own fstype and arguments long ago, nothing to check
+		log.Printf("WARN: ignoring %s for existing RBD Image %s/%s", metaMkfsOptions, pool, name)
+	}
 	if !exists {
 		if !*canCreateVolumes {
-			errString := fmt.Sprintf("Ceph RBD Image not found: %s", name)
-			log.Println("ERROR: " + errString)
-			return errors.New(errString)
+			err = newVolumeError(KindPolicyDenied, nil, "Ceph RBD Image not found: %s, and creating images is disabled (see --create)", name)
+			log.Printf("ERROR: %s", err)
+			return err
+		}
+		err = checkMkfsOptions(fstype, mkfsOptions)
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+			return err
 		}
 		// try to create it ... use size and default fs-type
-		err = d.createRBDImage(pool, name, size, fstype)
+		args := volumeMkfsArgs(fstype, mkfsOptions)
+		err = d.createRBDImage(pool, name, size, fstype, args)
+		if err != nil {
+			err = wrapVolumeError(err, "Unable to create Ceph RBD Image(%s)", name)
+			log.Printf("ERROR: %s", err)
+			return err
+		}
+		if len(args) > 0 {
+			err = d.setImageMeta(pool, name, metaMkfsOptions, strings.Join(args, " "))
+			if err != nil {
+				log.Printf("ERROR: %s", err)
+				return err
+			}
+		}
+	}
+
+	// per-volume settings go with the image, for whichever host mounts it.
+	// only write what changes: with the exclusive lock held by a kernel client
+	// an existing image takes no image-meta writes
+	settings := map[string]string{}
+	for _, key := range []string{metaLockWait, metaAccess, metaFSPolicy, metaMountOptions} {
+		if r.Options[key] != "" {
+			settings[key] = r.Options[key]
+		}
+	}
+	meta := map[string]string{}
+	if exists && len(settings) > 0 {
+		meta, err = d.imageMeta(pool, name)
+		if err != nil {
+			err = wrapVolumeError(err, "Unable to read image-meta of %s/%s", pool, name)
+			log.Printf("ERROR: %s", err)
+			return err
+		}
+		for key, value := range settings {
+			if meta[key] == value {
+				delete(settings, key)
+			}
+		}
+	}
+	if exists && len(settings) > 0 {
+		if access, ok := settings[metaAccess]; ok {
+			err = d.checkAccessChange(pool, name, meta, access)
+			if err != nil {
+				log.Printf("ERROR: %s", err)
+				return err
+			}
+		}
+		err = d.checkExclusiveLockFree(pool, name, "change settings of")
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+			return err
+		}
+	}
+	if exists && sizeGiven {
+		err = d.growImage(pool, name, size)
 		if err != nil {
-			errString := fmt.Sprintf("Unable to create Ceph RBD Image(%s): %s", name, err)
-			log.Println("ERROR: " + errString)
-			return errors.New(errString)
+			err = wrapVolumeError(err, "Unable to grow Ceph RBD Image(%s)", name)
+			log.Printf("ERROR: %s", err)
+			return err
+		}
+	}
+	for _, key := range []string{metaLockWait, metaAccess, metaFSPolicy, metaMountOptions} {
+		if _, ok := settings[key]; !ok {
+			continue
+		}
+		err = d.setImageMeta(pool, name, key, settings[key])
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+			return err
 		}
 	}
 
@@ -220,40 +379,47 @@ func (d cephRBDVolumeDriver) createImage(r *volume.CreateRequest) error {
 //
 func (d cephRBDVolumeDriver) Remove(r *volume.RemoveRequest) error {
 	log.Printf("INFO: API Remove(%s)", r)
-	d.m.Lock()
-	defer d.m.Unlock()
 
 	// parse full image name for optional/default pieces
 	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
 	if err != nil {
 		log.Printf("ERROR: parsing volume: %s", err)
-		return err
+		return newVolumeError(KindInvalidName, err, "Invalid volume name")
 	}
 
+	unlock := d.locks.lock(pool, name)
+	defer unlock()
+
 	mount := d.mountpoint(pool, name)
 
 	// do we know about this volume? does it matter?
-	if _, found := d.volumes[mount]; !found {
+	if _, found := d.getVolume(mount); !found {
 		log.Printf("WARN: Volume is not in known mounts: %s", mount)
 	}
 
 	exists, err := d.rbdImageExists(pool, name)
 	if err != nil {
-		log.Printf("ERROR: checking for RBD Image: %s", err)
+		// don't know - could be cluster down, auth failure, etc: never assume it's gone
+		err = wrapVolumeError(err, "Unable to check for Ceph RBD Image(%s/%s)", pool, name)
+		log.Printf("ERROR: %s", err)
 		return err
 	}
 	if !exists {
-		errString := fmt.Sprintf("Ceph RBD Image not found: %s", name)
-		log.Println("ERROR: " + errString)
-		return errors.New(errString)
+		err = newVolumeError(KindNotFound, nil, "Ceph RBD Image not found: %s", name)
+		log.Printf("ERROR: %s", err)
+		return err
 	}
 
 	// attempt to gain lock before remove - lock seems to disappear after rm (but not after rename)
 	locker, err := d.lockImage(pool, name)
 	if err != nil {
-		errString := fmt.Sprintf("Unable to lock image for remove: %s", name)
-		log.Println("ERROR: " + errString)
-		return errors.New(errString)
+		if isLockedElsewhere(err) {
+			err = newVolumeError(KindLocked, err, "Unable to lock image for remove: %s", name)
+		} else {
+			err = wrapVolumeError(err, "Unable to lock image for remove: %s", name)
+		}
+		log.Printf("ERROR: %s", err)
+		return err
 	}
 
 	// remove action can be: ignore, delete or rename
@@ -261,10 +427,15 @@ func (d cephRBDVolumeDriver) Remove(r *volume.RemoveRequest) error {
 		// delete it (for real - destroy it ... )
 		err = d.removeRBDImage(pool, name)
 		if err != nil {
-			errString := fmt.Sprintf("Unable to remove Ceph RBD Image(%s): %s", name, err)
-			log.Println("ERROR: " + errString)
+			// rbd rm exits EBUSY while the image still has watchers
+			if isExitCode(err, syscall.EBUSY) {
+				err = newVolumeError(KindBusy, err, "Unable to remove Ceph RBD Image(%s)", name)
+			} else {
+				err = wrapVolumeError(err, "Unable to remove Ceph RBD Image(%s)", name)
+			}
+			log.Printf("ERROR: %s", err)
 			defer d.unlockImage(pool, name, locker)
-			return errors.New(errString)
+			return err
 		}
 		defer d.unlockImage(pool, name, locker)
 	} else if removeActionFlag == "rename" {
@@ -272,11 +443,11 @@ func (d cephRBDVolumeDriver) Remove(r *volume.RemoveRequest) error {
 		// TODO: maybe add a timestamp?
 		err = d.renameRBDImage(pool, name, "zz_"+name)
 		if err != nil {
-			errString := fmt.Sprintf("Unable to rename with zz_ prefix: RBD Image(%s): %s", name, err)
-			log.Println("ERROR: " + errString)
+			err = wrapVolumeError(err, "Unable to rename with zz_ prefix: RBD Image(%s)", name)
+			log.Printf("ERROR: %s", err)
 			// unlock by old name
 			defer d.unlockImage(pool, name, locker)
-			return errors.New(errString)
+			return err
 		}
 		// unlock by new name
 		defer d.unlockImage(pool, "zz_"+name, locker)
@@ -285,7 +456,7 @@ func (d cephRBDVolumeDriver) Remove(r *volume.RemoveRequest) error {
 		defer d.unlockImage(pool, name, locker)
 	}
 
-	delete(d.volumes, mount)
+	d.deleteVolume(mount)
 	return nil
 }
 
@@ -304,37 +475,108 @@ func (d cephRBDVolumeDriver) Remove(r *volume.RemoveRequest) error {
 //    Respond with the path on the host filesystem where the volume has been
 //    made available, and/or a string error if an error occurred.
 //
-// TODO: utilize the new MountRequest.ID field to track volumes
+// Mounts are reference counted on MountRequest.ID, so several containers on
+// this host can share an already mounted volume. Read-only volumes (access=ro)
+// are not locked and can be mounted on several hosts at once, see mountReadOnly.
 func (d cephRBDVolumeDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
 	log.Printf("INFO: API Mount(%s)", r)
-	d.m.Lock()
-	defer d.m.Unlock()
 
 	// parse full image name for optional/default pieces
 	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
 	if err != nil {
 		log.Printf("ERROR: parsing volume: %s", err)
-		return nil, err
+		return nil, newVolumeError(KindInvalidName, err, "Invalid volume name")
 	}
 
+	unlock := d.locks.lock(pool, name)
+	defer unlock()
+
 	mount := d.mountpoint(pool, name)
 
-	// attempt to lock
-	locker, err := d.lockImage(pool, name)
+	// already mounted here? just add another user
+	if vol, found := d.getVolume(mount); found {
+		if indexOf(vol.MountIDs, r.ID) >= 0 {
+			// Docker retrying the same Mount, don't count it twice
+			log.Printf("INFO: Volume %s/%s already mounted on %s for %s", pool, name, mount, r.ID)
+			return &volume.MountResponse{Mountpoint: mount}, nil
+		}
+		vol.MountIDs = append(vol.MountIDs, r.ID)
+		log.Printf("INFO: Volume %s/%s already mounted on %s, now used by %d mount(s)", pool, name, mount, len(vol.MountIDs))
+		d.setVolume(mount, vol)
+		d.writeHeartbeat(vol)
+		return &volume.MountResponse{Mountpoint: mount}, nil
+	}
+
+	// our lock left by an Unmount while the cluster was unreachable
+	err = d.releasePendingUnlock(mount)
+	if err != nil {
+		err = wrapVolumeError(err, "Unable to release lock of %s/%s left by an earlier Unmount", pool, name)
+		log.Printf("ERROR: %s", err)
+		return nil, err
+	}
+
+	// volume settings, read once - see volumeLockWait
+	meta, err := d.imageMeta(pool, name)
+	if err != nil {
+		err = wrapVolumeError(err, "Unable to read image-meta of %s/%s", pool, name)
+		log.Printf("ERROR: %s", err)
+		return nil, err
+	}
+	if volumeReadOnly(meta) {
+		return d.mountReadOnly(pool, name, mount, r.ID, meta)
+	}
+
+	// attempt to lock - waiting a while for another host to let go, if configured.
+	// in exclusive mode the kernel client takes the lock when mapping
+	mode := d.imageLockMode(pool, name)
+	var locker, device string
+	if mode == lockModeExclusive {
+		device, err = d.mapImageExclusiveWait(pool, name, volumeLockWait(pool, name, meta))
+	} else {
+		locker, err = d.lockImageWait(pool, name, volumeLockWait(pool, name, meta))
+	}
 	if err != nil {
+		if isLockedElsewhere(err) {
+			// tell who has it, saves the operator hunting for it
+			if holders, herr := d.describeLockHolders(pool, name); herr == nil {
+				err = newVolumeError(KindLocked, nil, "Unable to get Exclusive Lock: %s", holders)
+			} else {
+				err = newVolumeError(KindLocked, err, "Unable to get Exclusive Lock")
+			}
+		} else {
+			err = wrapVolumeError(err, "Unable to get Exclusive Lock")
+		}
 		log.Printf("ERROR: locking RBD Image(%s): %s", name, err)
-		return nil, errors.New("Unable to get Exclusive Lock")
+		return nil, err
+	}
+
+	if mode == lockModeExclusive {
+		// the kernel client took the managed lock, remember which one is ours
+		cookie, cerr := d.exclusiveLockCookie(pool, name)
+		if cerr != nil {
+			log.Printf("WARN: unable to get exclusive lock cookie of %s/%s: %s", pool, name, cerr)
+		}
+		locker = cookie
+	}
+
+	// failsafe on errors below: release the advisory lock (exclusive: unmap does)
+	release := func() {
+		if mode != lockModeExclusive {
+			d.unlockImage(pool, name, locker)
+		}
 	}
 
 	// map and mount the RBD image -- these are OS level commands, not avail in go-ceph
 
 	// map
-	device, err := d.mapImage(pool, name)
-	if err != nil {
-		log.Printf("ERROR: mapping RBD Image(%s) to kernel device: %s", name, err)
-		// failsafe: need to release lock
-		defer d.unlockImage(pool, name, locker)
-		return nil, errors.New("Unable to map kernel device")
+	if mode != lockModeExclusive {
+		device, err = d.mapImage(pool, name)
+		if err != nil {
+			log.Printf("ERROR: mapping RBD Image(%s) to kernel device: %s", name, err)
+			// failsafe: need to release lock
+			defer release()
+			return nil, wrapVolumeError(err, "Unable to map kernel device")
+		}
 	}
 
 	// determine device FS type
@@ -345,14 +587,26 @@ func (d cephRBDVolumeDriver) Mount(r *volume.MountRequest) (*volume.MountRespons
 		fstype = *defaultImageFSType
 	}
 
-	// double check image filesystem if possible
-	err = d.verifyDeviceFilesystem(device, mount, fstype)
+	options, err := volumeMountOptions(fstype, meta)
+	if err != nil {
+		log.Printf("ERROR: mount options of RBD Image(%s): %s", name, err)
+		// failsafe: need to release lock and unmap kernel device
+		defer d.unmapImageDevice(device)
+		defer release()
+		return nil, err
+	}
+
+	// double check image filesystem if possible, fix what policy allows
+	err = d.verifyDeviceFilesystem(pool, name, device, mount, fstype, volumeFSPolicy(pool, name, meta))
 	if err != nil {
 		log.Printf("ERROR: filesystem may need repairs: %s", err)
 		// failsafe: need to release lock and unmap kernel device
 		defer d.unmapImageDevice(device)
-		defer d.unlockImage(pool, name, locker)
-		return nil, errors.New("Image filesystem has errors, requires manual repairs")
+		defer release()
+		if errorKindOf(err) == KindTimeout {
+			return nil, newVolumeError(KindTimeout, err, "Image filesystem check did not finish")
+		}
+		return nil, newVolumeError(KindFilesystemCorrupt, err, "Image filesystem has errors, requires manual repairs")
 	}
 
 	// check for mountdir - create if necessary
@@ -361,30 +615,106 @@ func (d cephRBDVolumeDriver) Mount(r *volume.MountRequest) (*volume.MountRespons
 		log.Printf("ERROR: creating mount directory: %s", err)
 		// failsafe: need to release lock and unmap kernel device
 		defer d.unmapImageDevice(device)
-		defer d.unlockImage(pool, name, locker)
-		return nil, errors.New("Unable to make mountdir")
+		defer release()
+		return nil, newVolumeError(KindInternal, err, "Unable to make mountdir")
 	}
 
 	// mount
-	err = d.mountDevice(fstype, device, mount)
+	err = d.mountDevice(fstype, device, mount, options...)
 	if err != nil {
 		log.Printf("ERROR: mounting device(%s) to directory(%s): %s", device, mount, err)
 		// need to release lock and unmap kernel device
 		defer d.unmapImageDevice(device)
-		defer d.unlockImage(pool, name, locker)
-		return nil, errors.New("Unable to mount device")
+		defer release()
+		return nil, wrapVolumeError(err, "Unable to mount device")
 	}
 
+	// catch up on an image grown while not mounted here, or by hand
+	d.growFilesystemOnMount(pool, name, fstype, device, mount, meta)
+
 	// if all that was successful - add to our list of volumes
-	d.volumes[mount] = &Volume{
-		Name:   name,
-		Device: device,
-		Locker: locker,
-		FStype: fstype,
-		Pool:   pool,
-		ID:     r.ID,
+	vol := &Volume{
+		Name:     name,
+		Device:   device,
+		Locker:   locker,
+		FStype:   fstype,
+		Pool:     pool,
+		MountIDs: []string{r.ID},
+		LockMode: mode,
+	}
+	if mode != lockModeExclusive {
+		// the client that keeps writing, fenced if our lease runs out
+		vol.Client = d.kernelClient(pool, name)
+	}
+	d.setVolume(mount, vol)
+	d.writeHeartbeat(vol)
+
+	return &volume.MountResponse{Mountpoint: mount}, nil
+}
+
+// mountReadOnly maps and mounts a read-only shared volume. No lock is taken,
+// so other hosts can mount it too, but it is refused while a writer holds the
+// image lock. The filesystem is neither checked nor repaired: the device is
+// read-only, and the mount options skip log recovery.
+func (d *cephRBDVolumeDriver) mountReadOnly(pool, name, mount, id string, meta map[string]string) (*volume.MountResponse, error) {
+	locks, err := d.rbdLockList(pool, name)
+	if err != nil {
+		log.Printf("ERROR: checking RBD Image(%s) for writers: %s", name, err)
+		return nil, wrapVolumeError(err, "Unable to check for writers")
+	}
+	if len(locks) > 0 {
+		holders, herr := d.describeLockHolders(pool, name)
+		if herr != nil {
+			holders = fmt.Sprintf("image %s/%s is locked by %s", pool, name, formatLockHolders(locks))
+		}
+		log.Printf("ERROR: read-only mount of RBD Image(%s) while locked: %s", name, holders)
+		return nil, newVolumeError(KindLocked, nil, "Unable to mount read-only while a writer holds the lock: %s", holders)
+	}
+
+	device, err := d.mapImageReadOnly(pool, name)
+	if err != nil {
+		log.Printf("ERROR: mapping RBD Image(%s) read-only to kernel device: %s", name, err)
+		return nil, wrapVolumeError(err, "Unable to map kernel device")
 	}
 
+	fstype, err := d.deviceType(device)
+	if err != nil {
+		log.Printf("WARN: unable to detect RBD Image(%s) fstype: %s", name, err)
+		fstype = *defaultImageFSType
+	}
+
+	options, err := volumeMountOptions(fstype, meta)
+	if err != nil {
+		log.Printf("ERROR: mount options of RBD Image(%s): %s", name, err)
+		defer d.unmapImageDevice(device)
+		return nil, err
+	}
+	options = append(filesystemFor(fstype).MountOptions(true), options...)
+
+	err = os.MkdirAll(mount, os.ModeDir|os.FileMode(int(0775)))
+	if err != nil {
+		log.Printf("ERROR: creating mount directory: %s", err)
+		defer d.unmapImageDevice(device)
+		return nil, newVolumeError(KindInternal, err, "Unable to make mountdir")
+	}
+
+	err = d.mountDevice(fstype, device, mount, options...)
+	if err != nil {
+		log.Printf("ERROR: mounting device(%s) read-only to directory(%s): %s", device, mount, err)
+		defer d.unmapImageDevice(device)
+		return nil, wrapVolumeError(err, "Unable to mount device")
+	}
+
+	log.Printf("INFO: mounted %s/%s read-only on %s", pool, name, mount)
+	d.setVolume(mount, &Volume{
+		Name:     name,
+		Device:   device,
+		FStype:   fstype,
+		Pool:     pool,
+		MountIDs: []string{id},
+		ReadOnly: true,
+	})
+
 	return &volume.MountResponse{Mountpoint: mount}, nil
 }
 
@@ -406,6 +736,8 @@ func (d cephRBDVolumeDriver) Mount(r *volume.MountRequest) (*volume.MountRespons
 func (d cephRBDVolumeDriver) List() (*volume.ListResponse, error) {
 	volNames, err := d.rbdList()
 	if err != nil {
+		err = wrapVolumeError(err, "Unable to list Ceph RBD Images in pool %s", d.pool)
+		log.Printf("ERROR: %s", err)
 		return nil, err
 	}
 	vols := make([]*volume.Volume, 0, len(volNames))
@@ -415,7 +747,7 @@ func (d cephRBDVolumeDriver) List() (*volume.ListResponse, error) {
 		// for each known mounted vol, add Mountpoint
 		// FIXME: assumes default rbd pool - should we keep track of all pools? query each? just assume one pool?
 		mount := d.mountpoint(d.pool, name)
-		_, ok := d.volumes[mount]
+		_, ok := d.getVolume(mount)
 		if ok {
 			apiVol.Mountpoint = mount
 		}
@@ -427,14 +759,24 @@ func (d cephRBDVolumeDriver) List() (*volume.ListResponse, error) {
 	return &volume.ListResponse{Volumes: vols}, nil
 }
 
-// rbdList performs an `rbd ls` on the default pool
+// rbdList performs an `rbd ls -l` on the default pool and returns the image names
 func (d *cephRBDVolumeDriver) rbdList() ([]string, error) {
-	result, err := d.rbdsh(d.pool, "ls")
+	out, err := d.rbdshJSON(d.pool, "ls", "-l")
 	if err != nil {
 		return nil, err
 	}
-	// split into lines - should be one rbd image name per line
-	return strings.Split(result, "\n"), nil
+	images, err := parseRBDList(out)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, img := range images {
+		// snapshots are listed as extra entries of their image
+		if img.Snapshot == "" {
+			names = append(names, img.Image)
+		}
+	}
+	return names, nil
 }
 
 // Get the volume info.
@@ -453,24 +795,27 @@ func (d cephRBDVolumeDriver) Get(r *volume.GetRequest) (*volume.GetResponse, err
 	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
 	if err != nil {
 		log.Printf("ERROR: parsing volume: %s", err)
-		return nil, err
+		return nil, newVolumeError(KindInvalidName, err, "Invalid volume name")
 	}
 
 	// Check to see if the image exists
 	exists, err := d.rbdImageExists(pool, name)
 	if err != nil {
-		log.Printf("WARN: checking for RBD Image: %s", err)
+		// don't know - keep any mount we know about
+		err = wrapVolumeError(err, "Unable to check for Ceph RBD Image(%s/%s)", pool, name)
+		log.Printf("ERROR: %s", err)
 		return nil, err
 	}
 	mountPath := d.mountpoint(pool, name)
 	if !exists {
+		// a volume we still have mounted stays known until its Unmount,
+		// Get doesn't change state behind a running Mount or Unmount
 		log.Printf("WARN: Image %s does not exist", r.Name)
-		delete(d.volumes, mountPath)
-		return nil, fmt.Errorf("Image %s does not exist", r.Name)
+		return nil, newVolumeError(KindNotFound, nil, "Image %s does not exist", r.Name)
 	}
 
 	// for each mounted vol, keep Mountpoint
-	_, ok := d.volumes[mountPath]
+	_, ok := d.getVolume(mountPath)
 	if !ok {
 		mountPath = ""
 	}
@@ -500,7 +845,7 @@ func (d cephRBDVolumeDriver) Path(r *volume.PathRequest) (*volume.PathResponse,
 	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
 	if err != nil {
 		log.Printf("ERROR: parsing volume: %s", err)
-		return nil, err
+		return nil, newVolumeError(KindInvalidName, err, "Invalid volume name")
 	}
 
 	mountPath := d.mountpoint(pool, name)
@@ -523,22 +868,25 @@ func (d cephRBDVolumeDriver) Path(r *volume.PathRequest) (*volume.PathResponse,
 //
 func (d cephRBDVolumeDriver) Unmount(r *volume.UnmountRequest) error {
 	log.Printf("INFO: API Unmount(%s)", r)
-	d.m.Lock()
-	defer d.m.Unlock()
 
 	var err_msgs = []string{}
+	var errKind ErrorKind // of the first error
 
 	// parse full image name for optional/default pieces
 	pool, name, _, err := d.parseImagePoolNameSize(r.Name)
 	if err != nil {
 		log.Printf("ERROR: parsing volume: %s", err)
-		return err
+		return newVolumeError(KindInvalidName, err, "Invalid volume name")
 	}
 
+	unlock := d.locks.lock(pool, name)
+	defer unlock()
+
 	mount := d.mountpoint(pool, name)
 
-	// check if it's in our mounts - we may not know about it if plugin was started late?
-	vol, found := d.volumes[mount]
+	// check if it's in our mounts - restored from state file after a restart,
+	// so we may only not know about it if it was mounted by something else
+	vol, found := d.getVolume(mount)
 	if !found {
 		// FIXME: is this an error or just a log and a return nil?
 		//return fmt.Errorf("WARN: Volume is not in known mounts: ignoring request to unmount: %s/%s", pool, name)
@@ -553,16 +901,27 @@ func (d cephRBDVolumeDriver) Unmount(r *volume.UnmountRequest) error {
 			Name:   name,
 			Device: fmt.Sprintf("/dev/rbd/%s/%s", pool, name),
 			Locker: d.localLockerCookie(),
-			ID, r.ID,
+			MountIDs: []string{r.ID},
 		}
 		*/
 	}
 
-	// if found - double check ID
-	if vol.ID != r.ID {
-		log.Printf("WARN: Volume client ID(%s) does not match requestor id(%s) for %s/%s",
-			vol.ID, r.ID, pool, name)
-		return nil
+	// drop this user - only the last one actually unmounts. mount IDs are
+	// unknown for volumes adopted at startup, so any Unmount is the last one
+	if len(vol.MountIDs) > 0 {
+		i := indexOf(vol.MountIDs, r.ID)
+		if i < 0 {
+			log.Printf("WARN: Volume mount IDs(%q) do not include requestor id(%s) for %s/%s",
+				vol.MountIDs, r.ID, pool, name)
+			return nil
+		}
+		vol.MountIDs = append(vol.MountIDs[:i], vol.MountIDs[i+1:]...)
+		if len(vol.MountIDs) > 0 {
+			log.Printf("INFO: Volume %s/%s still used by %d mount(s), leaving it mounted", pool, name, len(vol.MountIDs))
+			d.setVolume(mount, vol)
+			d.writeHeartbeat(vol)
+			return nil
+		}
 	}
 
 	// unmount
@@ -571,36 +930,53 @@ func (d cephRBDVolumeDriver) Unmount(r *volume.UnmountRequest) error {
 	if err != nil {
 		log.Printf("ERROR: unmounting device(%s): %s", vol.Device, err)
 		// failsafe: will still attempt to unmap and unlock
-		err_msgs = append(err_msgs, "Error unmounting device")
+		err_msgs = append(err_msgs, fmt.Sprintf("Error unmounting device: %s", err))
+		errKind = errorKindOf(err)
 	}
 
 	// unmap
 	err = d.unmapImageDevice(vol.Device)
 	if err != nil {
 		log.Printf("ERROR: unmapping image device(%s): %s", vol.Device, err)
-		// NOTE: rbd unmap exits 16 if device is still being used - unlike umount.  try to recover differently in that case
-		if rbdUnmapBusyRegexp.MatchString(err.Error()) {
+		// NOTE: rbd unmap exits 16 (EBUSY) if device is still being used - unlike umount.  try to recover differently in that case
+		if isExitCode(err, syscall.EBUSY) {
 			// can't always re-mount and not sure if we should here ... will be cleaned up once original container goes away
 			log.Printf("WARN: unmap failed due to busy device, early exit from this Unmount request.")
-			return err
+			return newVolumeError(KindBusy, err, "Unable to unmap kernel device %s", vol.Device)
 		}
 		// other error, failsafe: proceed to attempt to unlock
-		err_msgs = append(err_msgs, "Error unmapping kernel device")
+		err_msgs = append(err_msgs, fmt.Sprintf("Error unmapping kernel device: %s", err))
+		if errKind == "" {
+			errKind = errorKindOf(err)
+		}
 	}
 
-	// unlock
-	err = d.unlockImage(vol.Pool, vol.Name, vol.Locker)
-	if err != nil {
-		log.Printf("ERROR: unlocking RBD image(%s): %s", vol.Name, err)
-		err_msgs = append(err_msgs, "Error unlocking image")
+	// unlock - the exclusive lock went with the unmap, read-only volumes have none
+	pendingUnlock := false
+	if vol.LockMode != lockModeExclusive && !vol.ReadOnly {
+		d.clearHeartbeat(vol.Pool, vol.Name)
+		err = d.unlockImage(vol.Pool, vol.Name, vol.Locker)
+		if err != nil {
+			log.Printf("ERROR: unlocking RBD image(%s): %s", vol.Name, err)
+			err_msgs = append(err_msgs, fmt.Sprintf("Error unlocking image: %s", err))
+			if errKind == "" {
+				errKind = errorKindOf(err)
+			}
+			// released once the cluster answers again, or by the next Mount
+			pendingUnlock = isCephUnreachable(err)
+		}
 	}
 
 	// forget it
-	delete(d.volumes, mount)
+	if pendingUnlock {
+		d.setPendingUnlock(mount, vol)
+	} else {
+		d.deleteVolume(mount)
+	}
 
 	// check for piled up errors
 	if len(err_msgs) > 0 {
-		return errors.New(strings.Join(err_msgs, ", "))
+		return newVolumeError(errKind, nil, "%s", strings.Join(err_msgs, ", "))
 	}
 
 	return nil
@@ -618,6 +994,105 @@ func (d *cephRBDVolumeDriver) mountpoint(pool, name string) string {
 	return filepath.Join(d.root, pool, name)
 }
 
+// getVolume returns a copy of the known volume mounted at mountpoint - use
+// setVolume to change it
+func (d *cephRBDVolumeDriver) getVolume(mount string) (*Volume, bool) {
+	d.m.RLock()
+	defer d.m.RUnlock()
+
+	vol, found := d.volumes[mount]
+	if !found {
+		return nil, false
+	}
+	cp := *vol
+	cp.MountIDs = append([]string{}, vol.MountIDs...)
+	return &cp, true
+}
+
+// setVolume adds or replaces the known volume at mountpoint and saves state
+func (d *cephRBDVolumeDriver) setVolume(mount string, vol *Volume) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.volumes[mount] = vol
+	d.saveState()
+}
+
+// deleteVolume forgets the volume at mountpoint (if known) and saves state
+func (d *cephRBDVolumeDriver) deleteVolume(mount string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if _, found := d.volumes[mount]; found {
+		delete(d.volumes, mount)
+		d.saveState()
+	}
+}
+
+// setPendingUnlock moves the volume at mountpoint from the known mounts to
+// the locks still to release, and saves state
+func (d *cephRBDVolumeDriver) setPendingUnlock(mount string, vol *Volume) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	delete(d.volumes, mount)
+	d.pendingUnlocks[mount] = vol
+	d.saveState()
+}
+
+// releasePendingUnlock releases our lock left on the volume at mountpoint by
+// an Unmount that couldn't reach the cluster, caller must hold the volume
+// lock. Only errors reaching the cluster keep it pending, a lock that is no
+// longer ours (e.g. broken by another host) is forgotten.
+func (d *cephRBDVolumeDriver) releasePendingUnlock(mount string) error {
+	d.m.RLock()
+	vol, found := d.pendingUnlocks[mount]
+	d.m.RUnlock()
+	if !found {
+		return nil
+	}
+
+	// the heartbeat may be another host's by now
+	if hb, err := d.imageHeartbeat(vol.Pool, vol.Name, vol.Locker); err == nil && hb != nil {
+		d.clearHeartbeat(vol.Pool, vol.Name)
+	}
+	err := d.unlockImage(vol.Pool, vol.Name, vol.Locker)
+	if err != nil && isCephUnreachable(err) {
+		return err
+	}
+	if err != nil {
+		log.Printf("WARN: giving up on releasing lock of %s/%s left by an earlier Unmount: %s", vol.Pool, vol.Name, err)
+	} else {
+		log.Printf("INFO: released lock of %s/%s left by an earlier Unmount", vol.Pool, vol.Name)
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	delete(d.pendingUnlocks, mount)
+	d.saveState()
+	return nil
+}
+
+// releasePendingUnlocks retries every pending lock release, e.g. once the
+// cluster answers again
+func (d *cephRBDVolumeDriver) releasePendingUnlocks() {
+	d.m.RLock()
+	pending := map[string]*Volume{}
+	for mount, vol := range d.pendingUnlocks {
+		pending[mount] = vol
+	}
+	d.m.RUnlock()
+
+	for mount, vol := range pending {
+		unlock := d.locks.lock(vol.Pool, vol.Name)
+		err := d.releasePendingUnlock(mount)
+		unlock()
+		if err != nil {
+			log.Printf("WARN: unable to release lock of %s/%s, trying again later: %s", vol.Pool, vol.Name, err)
+		}
+	}
+}
+
 // parseImagePoolNameSize parses out any optional parameters from Image Name
 // passed from docker run. Fills in unspecified options with default pool or
 // size.
@@ -670,64 +1145,90 @@ func (d *cephRBDVolumeDriver) parseImagePoolNameSize(fullname string) (pool stri
 	return pool, imagename, size, nil
 }
 
-// rbdImageExists will check for an existing Ceph RBD Image
+// nameHasSize checks for a @size in the full image name
+func nameHasSize(fullname string) bool {
+	matches := imageNameRegexp.FindStringSubmatch(fullname)
+	return len(matches) == 6 && matches[5] != ""
+}
+
+// rbdImageExists will check for an existing Ceph RBD Image. Three results:
+//
+//   true, nil  - image exists
+//   false, nil - image (or pool) not found: rbd exits with ENOENT
+//   false, err - unable to tell, e.g. monitors unreachable or auth failure
 func (d *cephRBDVolumeDriver) rbdImageExists(pool, findName string) (bool, error) {
-	_, err := d.rbdsh(pool, "info", findName)
+	if findName == "" {
+		return false, errors.New("Unable to check for RBD Image without name")
+	}
+	_, err := d.rbdImageInfo(pool, findName)
 	if err != nil {
-		// NOTE: even though method signature returns err - we take the error
-		// in this instance as the indication that the image does not exist
-		// TODO: can we double check exit value for exit status 2 ?
-		return false, nil
+		if isExitCode(err, syscall.ENOENT) {
+			return false, nil
+		}
+		return false, err
 	}
 	return true, nil
 }
 
-// createRBDImage will create a new Ceph block device and make a filesystem on it
-func (d *cephRBDVolumeDriver) createRBDImage(pool string, name string, size int, fstype string) error {
+// createRBDImage will create a new Ceph block device and make a filesystem on it,
+// passing mkfsArgs to mkfs
+func (d *cephRBDVolumeDriver) createRBDImage(pool string, name string, size int, fstype string, mkfsArgs []string) error {
 	log.Printf("INFO: Attempting to create new RBD Image: (%s/%s, %s, %s)", pool, name, size, fstype)
 
 	// check that fs is valid type (needs mkfs.fstype in PATH)
-	mkfs, err := exec.LookPath("mkfs." + fstype)
+	_, err := d.runner.LookPath("mkfs." + fstype)
 	if err != nil {
 		msg := fmt.Sprintf("Unable to find mkfs for %s in PATH: %s", fstype, err)
 		return errors.New(msg)
 	}
 
-	// create the block device image with format=2 (v2) - features seem heavily dependent on version and configuration of RBD pools
-	//  should we enable all v2 image features?: +1: layering support +2: striping v2 support +4: exclusive locking support +8: object map support
-	// NOTE: i tried but "2015-08-02 20:24:36.726758 7f87787907e0 -1 librbd: librbd does not support requested features."
-	// NOTE: I also tried just image-features=4 (locking) - but map will fail:
-	//       sudo rbd unmap mynewvol =>  rbd: 'mynewvol' is not a block device, rbd: unmap failed: (22) Invalid argument
-	//	"--image-features", strconv.Itoa(4),
-
-	_, err = d.rbdsh(
-		pool, "create",
+	// create the block device image with format=2 (v2) - features depend heavily
+	// on version and configuration of RBD pools and the kernel client, so only
+	// ask for exclusive-lock (needs kernel 4.9+ to map) in exclusive lock mode
+	args := []string{
 		"--image-format", strconv.Itoa(2),
 		"--size", strconv.Itoa(size),
-		name,
-	)
-	if err != nil {
-		return err
 	}
-
-	// lock it temporarily for fs creation
-	lockname, err := d.lockImage(pool, name)
+	if lockModeFlag == lockModeExclusive {
+		args = append(args, "--image-feature", "layering,exclusive-lock")
+	}
+	_, err = d.rbdsh(pool, "create", append(args, name)...)
 	if err != nil {
 		return err
 	}
 
-	// map to kernel device
-	device, err := d.mapImage(pool, name)
-	if err != nil {
-		defer d.unlockImage(pool, name, lockname)
-		return err
+	// lock and map it temporarily for fs creation
+	var lockname, device string
+	if lockModeFlag == lockModeExclusive {
+		device, err = d.mapImageExclusive(pool, name)
+		if err != nil {
+			return err
+		}
+	} else {
+		lockname, err = d.lockImage(pool, name)
+		if err != nil {
+			return err
+		}
+
+		// map to kernel device
+		device, err = d.mapImage(pool, name)
+		if err != nil {
+			defer d.unlockImage(pool, name, lockname)
+			return err
+		}
+	}
+	unlock := func() error {
+		if lockModeFlag == lockModeExclusive {
+			return nil
+		}
+		return d.unlockImage(pool, name, lockname)
 	}
 
-	// make the filesystem - give it some time
-	_, err = shWithTimeout(5*time.Minute, mkfs, device)
+	// make the filesystem
+	err = filesystemFor(fstype).Make(d, device, mkfsArgs)
 	if err != nil {
 		defer d.unmapImageDevice(device)
-		defer d.unlockImage(pool, name, lockname)
+		defer unlock()
 		return err
 	}
 
@@ -742,7 +1243,7 @@ func (d *cephRBDVolumeDriver) createRBDImage(pool string, name string, size int,
 	}
 
 	// unlock
-	err = d.unlockImage(pool, name, lockname)
+	err = unlock()
 	if err != nil {
 		return err
 	}
@@ -750,73 +1251,285 @@ func (d *cephRBDVolumeDriver) createRBDImage(pool string, name string, size int,
 	return nil
 }
 
-// rbdImageIsLocked returns true if named image is already locked
-func (d *cephRBDVolumeDriver) rbdImageIsLocked(pool, name string) (bool, error) {
-	// check the output for a lock -- if blank or error, assume not locked (?)
-	out, err := d.rbdsh(pool, "lock", "ls", name)
-	if err != nil || out != "" {
-		return false, err
+// growImage grows the image to size MB, it never shrinks. The filesystem is
+// grown right away if the volume is mounted here, otherwise on its next Mount
+// (see growFilesystemOnMount).
+func (d *cephRBDVolumeDriver) growImage(pool, name string, size int) error {
+	info, err := d.rbdImageInfo(pool, name)
+	if err != nil {
+		return err
 	}
-	// otherwise - no error and output is not blank - assume a lock exists ...
-	return true, nil
+	current := int(info.Size >> 20)
+	if size < current {
+		log.Printf("WARN: not shrinking RBD Image %s/%s from %dMB to %dMB", pool, name, current, size)
+		return nil
+	}
+	if size == current {
+		return nil
+	}
+
+	err = d.checkExclusiveLockFree(pool, name, "grow")
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: growing RBD Image %s/%s from %dMB to %dMB", pool, name, current, size)
+	_, err = d.rbdsh(pool, "resize", "--size", strconv.Itoa(size), name)
+	if err != nil {
+		return err
+	}
+	// whoever mounts it next grows the filesystem, unless we can right now
+	err = d.setImageMeta(pool, name, metaGrowFilesystem, strconv.Itoa(size))
+	if err != nil {
+		return err
+	}
+
+	mount := d.mountpoint(pool, name)
+	vol, mounted := d.getVolume(mount)
+	if !mounted || vol.ReadOnly {
+		return nil
+	}
+	err = d.growFilesystem(vol.FStype, vol.Device, mount)
+	if err != nil {
+		return fmt.Errorf("image grown, but not its filesystem (retried on next Mount): %s", err)
+	}
+	return d.removeImageMeta(pool, name, metaGrowFilesystem)
+}
+
+// describeLockHolders explains who holds the lock on an image, along with the
+// clients watching it (i.e. having it open or mapped), for error messages
+func (d *cephRBDVolumeDriver) describeLockHolders(pool, name string) (string, error) {
+	locks, err := d.rbdLockList(pool, name)
+	if err != nil {
+		return "", err
+	}
+	if len(locks) == 0 {
+		return fmt.Sprintf("image %s/%s is not locked", pool, name), nil
+	}
+	msg := fmt.Sprintf("image %s/%s is locked by %s", pool, name, formatLockHolders(locks))
+	if len(locks) == 1 {
+		hb, err := d.imageHeartbeat(pool, name, locks[0].ID)
+		if err != nil {
+			log.Printf("WARN: unable to get heartbeat of %s/%s: %s", pool, name, err)
+		} else if hb != nil {
+			msg += ", " + hb.describe(time.Now())
+		}
+	}
+
+	watchers, err := d.rbdWatchers(pool, name)
+	if err != nil {
+		log.Printf("WARN: unable to get watchers of %s/%s: %s", pool, name, err)
+		return msg, nil
+	}
+	if len(watchers) == 0 {
+		return msg + ", no watchers", nil
+	}
+	return msg + ", watched by " + formatWatchers(watchers), nil
+}
+
+// checkAccessChange refuses to change the access mode of an existing image
+// (with the given image-meta) while any host has it mapped: readers would end
+// up sharing it with a writer, or a writer with readers
+func (d *cephRBDVolumeDriver) checkAccessChange(pool, name string, meta map[string]string, access string) error {
+	current := meta[metaAccess]
+	if current == "" {
+		current = accessReadWrite
+	}
+	if current == access {
+		return nil
+	}
+	watchers, err := d.rbdWatchers(pool, name)
+	if err != nil {
+		return wrapVolumeError(err, "Unable to check watchers of %s/%s", pool, name)
+	}
+	if len(watchers) > 0 {
+		return newVolumeError(KindBusy, nil, "Unable to change %s of %s/%s from %s to %s while it is mapped, watched by %s",
+			metaAccess, pool, name, current, access, formatWatchers(watchers))
+	}
+	return nil
+}
+
+// checkExclusiveLockFree refuses changes needing the image's exclusive lock
+// while a kernel client holds it: mapped with -o exclusive it never hands the
+// lock over, so rbd resize or image-meta set would fail
+func (d *cephRBDVolumeDriver) checkExclusiveLockFree(pool, name, change string) error {
+	locks, err := d.rbdLockList(pool, name)
+	if err != nil {
+		return wrapVolumeError(err, "Unable to check locks of %s/%s", pool, name)
+	}
+	for _, lock := range locks {
+		if strings.HasPrefix(lock.ID, exclusiveLockCookiePrefix) {
+			return newVolumeError(KindBusy, nil, "Unable to %s %s/%s while it is mapped with the exclusive lock, held by %s",
+				change, pool, name, describeLock(lock))
+		}
+	}
+	return nil
 }
 
 // lockImage locks image and returns locker cookie name
 func (d *cephRBDVolumeDriver) lockImage(pool, imagename string) (string, error) {
-	cookie := d.localLockerCookie()
-	_, err := d.rbdsh(pool, "lock", "add", imagename, cookie)
+	cookie := d.cookie
+	cookie.Since = time.Now()
+	_, err := d.rbdsh(pool, "lock", "add", imagename, cookie.String())
 	if err != nil {
 		return "", err
 	}
-	return cookie, nil
+	return cookie.String(), nil
 }
 
-// localLockerCookie returns the Hostname
-func (d *cephRBDVolumeDriver) localLockerCookie() string {
-	host, err := os.Hostname()
+// lockImageWait locks the image like lockImage. If another host holds the
+// lock it retries, with backoff, for up to wait (the volume lock wait, see
+// volumeLockWait), e.g. to let the old host of a moved container Unmount.
+func (d *cephRBDVolumeDriver) lockImageWait(pool, imagename string, wait time.Duration) (string, error) {
+	return d.waitForLock(pool, imagename, wait, func() (string, error) {
+		return d.tryLockImage(pool, imagename)
+	})
+}
+
+// mapImageExclusiveWait maps the image like mapImageExclusive, waiting for
+// another host to let go of the lock like lockImageWait
+func (d *cephRBDVolumeDriver) mapImageExclusiveWait(pool, imagename string, wait time.Duration) (string, error) {
+	return d.waitForLock(pool, imagename, wait, func() (string, error) {
+		return d.mapImageExclusive(pool, imagename)
+	})
+}
+
+// waitForLock calls acquire until it succeeds, fails for another reason than
+// the image being locked by another host, or the wait time is up
+func (d *cephRBDVolumeDriver) waitForLock(pool, imagename string, wait time.Duration, acquire func() (string, error)) (string, error) {
+	result, err := acquire()
+	if err == nil || !isLockedElsewhere(err) {
+		return result, err
+	}
+	if wait <= 0 {
+		return "", err
+	}
+
+	log.Printf("INFO: %s/%s is locked by another host, waiting up to %s for the lock", pool, imagename, wait)
+	deadline := time.Now().Add(wait)
+	backoff := lockWaitInitialBackoff
+	for {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			log.Printf("WARN: gave up waiting %s for the lock on %s/%s", wait, pool, imagename)
+			return "", err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > lockWaitMaxBackoff {
+			backoff = lockWaitMaxBackoff
+		}
+
+		result, err = acquire()
+		if err == nil {
+			log.Printf("INFO: got the lock on %s/%s after waiting %s", pool, imagename, wait-deadline.Sub(time.Now()))
+			return result, nil
+		}
+		if !isLockedElsewhere(err) {
+			return "", err
+		}
+	}
+}
+
+// isLockedElsewhere checks for rbd failing because another client holds the
+// image lock: lock add exits EBUSY, an exclusive map EBUSY or EROFS
+func isLockedElsewhere(err error) bool {
+	return isExitCode(err, syscall.EBUSY) || isExitCode(err, syscall.EROFS)
+}
+
+// imageLockMode decides how to lock an image: exclusive if asked for with
+// --lock-mode and the image has the exclusive-lock feature, advisory otherwise
+func (d *cephRBDVolumeDriver) imageLockMode(pool, name string) string {
+	if lockModeFlag != lockModeExclusive {
+		return lockModeAdvisory
+	}
+	info, err := d.rbdImageInfo(pool, name)
 	if err != nil {
-		log.Printf("WARN: HOST_UNKNOWN: unable to get hostname: %s", err)
-		host = "HOST_UNKNOWN"
+		log.Printf("WARN: unable to get features of %s/%s, using advisory lock: %s", pool, name, err)
+		return lockModeAdvisory
 	}
-	return host
+	if !contains(info.Features, "exclusive-lock") {
+		log.Printf("INFO: %s/%s has no exclusive-lock feature, using advisory lock", pool, name)
+		return lockModeAdvisory
+	}
+	return lockModeExclusive
+}
+
+// localLockerCookie returns the lock cookie of this plugin instance, see lockCookie
+func (d *cephRBDVolumeDriver) localLockerCookie() string {
+	return d.cookie.String()
+}
+
+// findLock picks the lock with exactly the given cookie (lock id). Matching is
+// on the parsed fields only, so e.g. node1 never matches node10's lock.
+func findLock(locks []rbdLock, cookie string) (rbdLock, error) {
+	found := []rbdLock{}
+	for _, lock := range locks {
+		if lock.ID == cookie {
+			found = append(found, lock)
+		}
+	}
+	switch {
+	case len(found) == 1:
+		return found[0], nil
+	case len(found) > 1:
+		return rbdLock{}, fmt.Errorf("%d locks with cookie %s, held by: %s", len(found), cookie, formatLockHolders(found))
+	}
+	return rbdLock{}, fmt.Errorf("no lock with cookie %s, held by: %s", cookie, formatLockHolders(locks))
+}
+
+// formatLockHolders lists lock holders for error messages
+func formatLockHolders(locks []rbdLock) string {
+	if len(locks) == 0 {
+		return "nobody"
+	}
+	holders := make([]string, len(locks))
+	for i, lock := range locks {
+		holders[i] = describeLock(lock)
+	}
+	return strings.Join(holders, "; ")
+}
+
+// formatWatchers lists the clients watching an image for messages
+func formatWatchers(watchers []rbdWatcher) string {
+	clients := make([]string, len(watchers))
+	for i, w := range watchers {
+		clients[i] = fmt.Sprintf("client.%d at %s", w.Client, w.Address)
+	}
+	return strings.Join(clients, ", ")
 }
 
 // unlockImage releases the exclusive lock on an image
 func (d *cephRBDVolumeDriver) unlockImage(pool, imagename, locker string) error {
 	if locker == "" {
-		log.Printf("WARN: Attempting to unlock image(%s/%s) for empty locker using default hostname", pool, imagename)
-		// try to unlock using the local hostname
-		locker = d.localLockerCookie()
+		log.Printf("WARN: Attempting to unlock image(%s/%s) for empty locker using our cookie", pool, imagename)
+		// try to unlock whatever lock this plugin instance holds
+		ours, err := d.rbdImageLockedBy(pool, imagename, "")
+		if err != nil {
+			return err
+		}
+		locker = ours
+		if locker == "" {
+			locker = d.localLockerCookie()
+		}
 	}
 	log.Printf("INFO: unlockImage(%s/%s, %s)", pool, imagename, locker)
 
-	// first - we need to discover the client id of the locker -- so we have to
-	// `rbd lock list` and grep out fields
-	out, err := d.rbdsh(pool, "lock", "list", imagename)
-	if err != nil || out == "" {
+	// first - we need to discover the client id of the locker
+	locks, err := d.rbdLockList(pool, imagename)
+	if err != nil || len(locks) == 0 {
 		log.Printf("ERROR: image not locked or ceph rbd error: %s", err)
 		return err
 	}
 
-	// parse out client id -- assume we looking for a line with the locker cookie on it --
-	var clientid string
-	lines := grepLines(out, locker)
-	if isDebugEnabled() {
-		log.Printf("DEBUG: found lines matching %s:\n%s\n", locker, lines)
-	}
-	if len(lines) == 1 {
-		// grab first word of first line as the client.id ?
-		tokens := strings.SplitN(lines[0], " ", 2)
-		if tokens[0] != "" {
-			clientid = tokens[0]
-		}
-	}
-
-	if clientid == "" {
-		return errors.New("sh_unlockImage: Unable to determine client.id")
+	lock, err := findLock(locks, locker)
+	if err != nil {
+		return fmt.Errorf("Unable to unlock image(%s/%s): %s", pool, imagename, err)
 	}
 
-	_, err = d.rbdsh(pool, "lock", "rm", imagename, locker, clientid)
+	_, err = d.rbdsh(pool, "lock", "rm", imagename, lock.ID, lock.Locker)
 	if err != nil {
 		return err
 	}
@@ -849,8 +1562,12 @@ func (d *cephRBDVolumeDriver) renameRBDImage(pool, name, newname string) error {
 }
 
 // mapImage will map the RBD Image to a kernel device
-func (d *cephRBDVolumeDriver) mapImage(pool, imagename string) (string, error) {
-	device, err := d.rbdsh(pool, "map", imagename)
+func (d *cephRBDVolumeDriver) mapImage(pool, imagename string, options ...string) (string, error) {
+	args := []string{imagename}
+	if len(options) > 0 {
+		args = append(args, "--options", strings.Join(options, ","))
+	}
+	device, err := d.rbdsh(pool, "map", args...)
 	// NOTE: ubuntu rbd map seems to not return device. if no error, assume "default" /dev/rbd/<pool>/<image> device
 	if device == "" && err == nil {
 		device = fmt.Sprintf("/dev/rbd/%s/%s", pool, imagename)
@@ -859,6 +1576,37 @@ func (d *cephRBDVolumeDriver) mapImage(pool, imagename string) (string, error) {
 	return device, err
 }
 
+// mapImageExclusive maps the image with the kernel client taking the
+// exclusive lock, and keeping it until unmapped. Fails (EBUSY or EROFS) if
+// another client holds it.
+func (d *cephRBDVolumeDriver) mapImageExclusive(pool, imagename string) (string, error) {
+	return d.mapImage(pool, imagename, "exclusive")
+}
+
+// exclusiveLockCookie returns the cookie of the managed lock, e.g. "auto
+// 18446462598732840961", right after mapping took it. It changes whenever the
+// kernel client reacquires the lock.
+func (d *cephRBDVolumeDriver) exclusiveLockCookie(pool, imagename string) (string, error) {
+	locks, err := d.rbdLockList(pool, imagename)
+	if err != nil {
+		return "", err
+	}
+	if len(locks) != 1 || !strings.HasPrefix(locks[0].ID, exclusiveLockCookiePrefix) {
+		return "", fmt.Errorf("expected the exclusive lock only, found: %s", formatLockHolders(locks))
+	}
+	return locks[0].ID, nil
+}
+
+// mapImageReadOnly maps the image to a read-only kernel device, which never
+// takes the exclusive lock
+func (d *cephRBDVolumeDriver) mapImageReadOnly(pool, imagename string) (string, error) {
+	device, err := d.rbdsh(pool, "map", imagename, "--read-only")
+	if device == "" && err == nil {
+		device = fmt.Sprintf("/dev/rbd/%s/%s", pool, imagename)
+	}
+	return device, err
+}
+
 // unmapImageDevice will release the mapped kernel device
 func (d *cephRBDVolumeDriver) unmapImageDevice(device string) error {
 	// NOTE: this does not even require a user nor a pool, just device name
@@ -872,7 +1620,7 @@ func (d *cephRBDVolumeDriver) unmapImageDevice(device string) error {
 func (d *cephRBDVolumeDriver) deviceType(device string) (string, error) {
 	// blkid Output:
 	//	xfs
-	blkid, err := shWithDefaultTimeout("blkid", "-o", "value", "-s", "TYPE", device)
+	blkid, err := d.sh("blkid", "-o", "value", "-s", "TYPE", device)
 	if err != nil {
 		return "", err
 	}
@@ -883,78 +1631,68 @@ func (d *cephRBDVolumeDriver) deviceType(device string) (string, error) {
 	}
 }
 
-// verifyDeviceFilesystem will attempt to check XFS filesystems for errors
-func (d *cephRBDVolumeDriver) verifyDeviceFilesystem(device, mount, fstype string) error {
-	// for now we only handle XFS
-	// TODO: use fsck for ext4?
-	if fstype != "xfs" {
-		return nil
-	}
-
-	// check XFS volume
-	err := d.xfsRepairDryRun(device)
-	if err != nil {
-		switch err.(type) {
-		case ShTimeoutError:
-			// propagate timeout errors - can't recover? system error? don't try to mount at that point
-			return err
-		default:
-			// assume any other error is xfs error and attempt limited repair
-			return d.attemptLimitedXFSRepair(fstype, device, mount)
-		}
-	}
-
-	return nil
-}
-
-func (d *cephRBDVolumeDriver) xfsRepairDryRun(device string) error {
-	// "xfs_repair  -n  (no  modify node) will return a status of 1 if filesystem
-	// corruption was detected and 0 if no filesystem corruption was detected." xfs_repair(8)
-	// TODO: can we check cmd output and ensure the mount/unmount is suggested by stale disk log?
-
-	_, err := shWithDefaultTimeout("xfs_repair", "-n", device)
-	return err
-}
-
-// attemptLimitedXFSRepair will try mount/unmount and return result of another xfs-repair-n
-func (d *cephRBDVolumeDriver) attemptLimitedXFSRepair(fstype, device, mount string) (err error) {
-	log.Printf("WARN: attempting limited XFS repair (mount/unmount) of %s  %s", device, mount)
-
-	// mount
-	err = d.mountDevice(fstype, device, mount)
-	if err != nil {
-		return err
-	}
-
-	// unmount
-	err = d.unmountDevice(device)
-	if err != nil {
-		return err
-	}
-
-	// try a dry-run again and return result
-	return d.xfsRepairDryRun(device)
-}
-
 // mountDevice will call mount on kernel device with a docker volume subdirectory
-func (d *cephRBDVolumeDriver) mountDevice(fstype, device, mountdir string) error {
-	_, err := shWithDefaultTimeout("mount", "-t", fstype, device, mountdir)
+func (d *cephRBDVolumeDriver) mountDevice(fstype, device, mountdir string, options ...string) error {
+	args := []string{"-t", fstype}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	_, err := d.sh("mount", append(args, device, mountdir)...)
 	return err
 }
 
 // unmountDevice will call umount on kernel device to unmount from host's docker subdirectory
 func (d *cephRBDVolumeDriver) unmountDevice(device string) error {
-	_, err := shWithDefaultTimeout("umount", device)
+	_, err := d.sh("umount", device)
 	return err
 }
 
 // UTIL
 
-// rbdsh will call rbd with the given command arguments, also adding config, user and pool flags
+// rbdsh will call rbd with the given command arguments, also adding config, user and pool flags.
+// Commands talking to the cluster go through the circuit breaker, see clusterSh.
 func (d *cephRBDVolumeDriver) rbdsh(pool, command string, args ...string) (string, error) {
+	args = d.rbdArgs(pool, command, args...)
+	// kernel only, work without the cluster
+	if command == "unmap" || command == "showmapped" {
+		return d.sh("rbd", args...)
+	}
+	return d.clusterSh("rbd", args...)
+}
+
+// rbdArgs adds config, user and pool flags to rbd command arguments
+func (d *cephRBDVolumeDriver) rbdArgs(pool, command string, args ...string) []string {
 	args = append([]string{"--conf", d.config, "--id", d.user, command}, args...)
 	if pool != "" {
 		args = append([]string{"--pool", pool}, args...)
 	}
-	return shWithDefaultTimeout("rbd", args...)
+	return args
+}
+
+// cephsh will call the ceph tool with the given arguments, also adding config and user flags
+func (d *cephRBDVolumeDriver) cephsh(args ...string) (string, error) {
+	return d.clusterSh("ceph", append([]string{"--conf", d.config, "--id", d.user}, args...)...)
+}
+
+// sh calls an external command through the driver runner using the defaultShellTimeout
+func (d *cephRBDVolumeDriver) sh(name string, args ...string) (string, error) {
+	return d.shWithTimeout(defaultShellTimeout, name, args...)
+}
+
+// shWithTimeout calls an external command through the driver runner, the
+// command is killed if it takes longer than howLong
+func (d *cephRBDVolumeDriver) shWithTimeout(howLong time.Duration, name string, args ...string) (string, error) {
+	// duration can't be zero
+	if howLong <= 0 {
+		return "", fmt.Errorf("Timeout duration needs to be positive")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), howLong)
+	defer cancel()
+	out, err := d.runner.Run(ctx, name, args...)
+	if timeoutErr, ok := err.(ShTimeoutError); ok {
+		// report the timeout we asked for, not how long it took to notice
+		timeoutErr.timeout = howLong
+		return out, timeoutErr
+	}
+	return out, err
 }
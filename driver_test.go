@@ -6,18 +6,22 @@ package main
 // unit tests that don't rely on ceph
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/stretchr/testify/assert"
 )
 
 // TODO: tests that need ceph
-// make fake cluster?
 // use dockerized container with ceph for tests?
+// most driver tests use the in-memory fakeRBD runner instead
 
 const (
 	TEST_SOCKET_PATH             = "/tmp/rbd-test.sock"
@@ -32,6 +36,11 @@ func TestMain(m *testing.M) {
 	flag.Parse()
 	cephConf := os.Getenv("CEPH_CONF")
 
+	stateDir, err := ioutil.TempDir("", "rbd-test-state")
+	if err != nil {
+		panic(err)
+	}
+
 	testDriver = newCephRBDVolumeDriver(
 		"test",
 		"",
@@ -39,17 +48,60 @@ func TestMain(m *testing.M) {
 		"rbd",
 		volume.DefaultDockerRootDirectory,
 		cephConf,
+		filepath.Join(stateDir, "test-volumes.json"),
 	)
 
 	handler := volume.NewHandler(testDriver)
 	// Serve won't return so spin off routine
 	go handler.ServeUnix(TEST_SOCKET_PATH, 0)
 
-	os.Exit(m.Run())
+	code := m.Run()
+	os.RemoveAll(stateDir)
+	os.Exit(code)
 }
 
 func TestLocalLockerCookie(t *testing.T) {
 	assert.NotEqual(t, "HOST_UNKNOWN", testDriver.localLockerCookie())
+
+	// hostnames sharing a prefix, and a cookie that is part of an address
+	locks := []rbdLock{
+		{ID: "node10", Locker: "client.4110", Address: "10.0.0.10:0/1"},
+		{ID: "node1", Locker: "client.4101", Address: "10.0.0.1:0/node1"},
+		{ID: "10.0.0.1", Locker: "client.4102", Address: "10.0.0.2:0/2"},
+	}
+	lock, err := findLock(locks, "node1")
+	assert.Nil(t, err, formatError("findLock", err))
+	assert.Equal(t, "client.4101", lock.Locker)
+	lock, err = findLock(locks, "node10")
+	assert.Nil(t, err, formatError("findLock", err))
+	assert.Equal(t, "client.4110", lock.Locker)
+	lock, err = findLock(locks, "10.0.0.1")
+	assert.Nil(t, err, formatError("findLock", err))
+	assert.Equal(t, "client.4102", lock.Locker)
+
+	_, err = findLock(locks, "node")
+	assert.NotNil(t, err, "Expected no match for cookie prefix")
+	assert.Contains(t, err.Error(), "host node10 (client.4110 at 10.0.0.10:0/1)")
+
+	// same cookie twice, e.g. two hosts with the same name
+	_, err = findLock(append(locks, rbdLock{ID: "node1", Locker: "client.4999", Address: "10.0.0.99:0/3"}), "node1")
+	assert.NotNil(t, err, "Expected error for ambiguous cookie")
+	assert.Contains(t, err.Error(), "client.4101")
+	assert.Contains(t, err.Error(), "client.4999")
+}
+
+func TestUnlockImage_prefixHostname(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	img := fake.addImage("rbd", "foo", "xfs")
+	img.locks = []rbdLock{
+		{ID: "node10", Locker: "client.4110", Address: "10.0.0.10:0/1"},
+		{ID: "node1", Locker: "client.4101", Address: "10.0.0.1:0/1"},
+	}
+
+	err := d.unlockImage("rbd", "foo", "node1")
+	assert.Nil(t, err, formatError("unlockImage", err))
+	assert.Equal(t, []rbdLock{{ID: "node10", Locker: "client.4110", Address: "10.0.0.10:0/1"}}, fake.image("rbd", "foo").locks)
 }
 
 func TestRbdImageExists_noName(t *testing.T) {
@@ -58,11 +110,397 @@ func TestRbdImageExists_noName(t *testing.T) {
 }
 
 func TestRbdImageExists_withName(t *testing.T) {
-	t.Skip("This fails for many reasons. Need to figure out how to do this in a container.")
-	err := testDriver.createRBDImage("rbd", "foo", 1, "xfs")
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	err := d.createRBDImage("rbd", "foo", 1, "xfs", nil)
 	assert.Nil(t, err, formatError("createRBDImage", err))
-	t_bool, err := testDriver.rbdImageExists(testDriver.pool, "foo")
+	t_bool, err := d.rbdImageExists(d.pool, "foo")
 	assert.Equal(t, true, t_bool, formatError("rbdImageExists", err))
+
+	// created with filesystem, left unlocked and unmapped
+	img := fake.image("rbd", "foo")
+	assert.Equal(t, "xfs", img.fstype)
+	assert.Equal(t, 0, len(img.locks), "Expected image to be unlocked after create")
+	assert.Equal(t, 0, len(fake.mapped), "Expected image to be unmapped after create")
+}
+
+func TestRbdImageExists_clusterDown(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	fake.addImage("rbd", "foo", "xfs")
+	fake.down = true
+
+	exists, err := d.rbdImageExists("rbd", "foo")
+	assert.False(t, exists)
+	assert.NotNil(t, err, "Expected error when cluster is unreachable")
+
+	fake.down = false
+	exists, err = d.rbdImageExists("rbd", "nope")
+	assert.False(t, exists)
+	assert.Nil(t, err, "Expected no error for missing image")
+}
+
+func TestCreate_clusterDown(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	*canCreateVolumes = true
+	defer func() { *canCreateVolumes = false }()
+	fake.down = true
+
+	err := d.Create(&volume.CreateRequest{Name: "foo"})
+	assert.NotNil(t, err, "Expected Create to fail when cluster is unreachable")
+	assert.Equal(t, 0, fake.countCalls("rbd --pool rbd --conf  --id admin create"), "Expected no create attempt")
+}
+
+func TestGet_clusterDown(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	fake.addImage("rbd", "foo", "xfs")
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+
+	fake.down = true
+	_, err = d.Get(&volume.GetRequest{Name: "foo"})
+	assert.NotNil(t, err, "Expected Get to fail when cluster is unreachable")
+	_, found := d.getVolume(d.mountpoint("rbd", "foo"))
+	assert.True(t, found, "Expected mounted volume to be kept")
+
+	err = d.Remove(&volume.RemoveRequest{Name: "foo"})
+	assert.NotNil(t, err, "Expected Remove to fail when cluster is unreachable")
+}
+
+func TestCreate_notAllowed(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	err := d.Create(&volume.CreateRequest{Name: "foo"})
+	assert.NotNil(t, err, "Expected error creating image without --create")
+	assert.Nil(t, fake.image("rbd", "foo"))
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	*canCreateVolumes = true
+	removeActionFlag = "delete"
+	defer func() {
+		*canCreateVolumes = false
+		removeActionFlag = "ignore"
+	}()
+
+	err := d.Create(&volume.CreateRequest{Name: "liverpool/foo@1024", Options: map[string]string{"fstype": "ext4"}})
+	assert.Nil(t, err, formatError("Create", err))
+	img := fake.image("liverpool", "foo")
+	if assert.NotNil(t, img, "Expected image to be created") {
+		assert.Equal(t, 1024, img.size)
+		assert.Equal(t, "ext4", img.fstype)
+	}
+
+	// first mount: lock, map and mount
+	res, err := d.Mount(&volume.MountRequest{Name: "liverpool/foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	mount := d.mountpoint("liverpool", "foo")
+	assert.Equal(t, mount, res.Mountpoint)
+	assert.Equal(t, 1, len(img.locks), "Expected image to be locked")
+	assert.Equal(t, "/dev/rbd0", fake.mounts[mount])
+
+	// second container shares the mount
+	maps := fake.countCalls("rbd --pool liverpool --conf  --id admin map")
+	res, err = d.Mount(&volume.MountRequest{Name: "liverpool/foo", ID: "c2"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, mount, res.Mountpoint)
+	assert.Equal(t, maps, fake.countCalls("rbd --pool liverpool --conf  --id admin map"), "Expected no second map")
+
+	get, err := d.Get(&volume.GetRequest{Name: "liverpool/foo"})
+	assert.Nil(t, err, formatError("Get", err))
+	assert.Equal(t, mount, get.Volume.Mountpoint)
+
+	// unknown mount ID is ignored
+	err = d.Unmount(&volume.UnmountRequest{Name: "liverpool/foo", ID: "nope"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Equal(t, 1, len(fake.mounts), "Expected volume to still be mounted")
+
+	err = d.Unmount(&volume.UnmountRequest{Name: "liverpool/foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Equal(t, 1, len(fake.mounts), "Expected volume to still be mounted for c2")
+
+	// last one out: unmount, unmap and unlock
+	err = d.Unmount(&volume.UnmountRequest{Name: "liverpool/foo", ID: "c2"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Equal(t, 0, len(fake.mounts), "Expected volume to be unmounted")
+	assert.Equal(t, 0, len(fake.mapped), "Expected volume to be unmapped")
+	assert.Equal(t, 0, len(img.locks), "Expected volume to be unlocked")
+
+	get, err = d.Get(&volume.GetRequest{Name: "liverpool/foo"})
+	assert.Nil(t, err, formatError("Get", err))
+	assert.Equal(t, "", get.Volume.Mountpoint)
+
+	err = d.Remove(&volume.RemoveRequest{Name: "liverpool/foo"})
+	assert.Nil(t, err, formatError("Remove", err))
+	assert.Nil(t, fake.image("liverpool", "foo"), "Expected image to be deleted")
+}
+
+func TestMount_sameIDTwice(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	fake.addImage("rbd", "foo", "xfs")
+
+	// Docker retrying a Mount: counted once, so one Unmount lets go of it
+	for i := 0; i < 2; i++ {
+		_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+		assert.Nil(t, err, formatError("Mount", err))
+	}
+	vol, _ := d.getVolume(d.mountpoint("rbd", "foo"))
+	assert.Equal(t, []string{"c1"}, vol.MountIDs)
+
+	err := d.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Equal(t, 0, len(fake.mounts), "Expected volume to be unmounted")
+	assert.Equal(t, 0, len(fake.mapped), "Expected volume to be unmapped")
+	assert.Equal(t, 0, len(fake.image("rbd", "foo").locks), "Expected volume to be unlocked")
+}
+
+func TestGet_removedImageStaysKnown(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	fake.addImage("rbd", "foo", "xfs")
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+
+	// image removed behind our back: Get tells, Unmount still cleans up
+	delete(fake.images, "rbd/foo")
+	_, err = d.Get(&volume.GetRequest{Name: "foo"})
+	assertErrorKind(t, KindNotFound, err)
+	_, found := d.getVolume(d.mountpoint("rbd", "foo"))
+	assert.True(t, found, "Expected Get not to drop the mounted volume")
+
+	err = d.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected unlock of the removed image to fail")
+	assert.Equal(t, 0, len(fake.mounts), "Expected volume to be unmounted")
+	assert.Equal(t, 0, len(fake.mapped), "Expected volume to be unmapped")
+}
+
+func TestMount_lockedByOtherHost(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "host=otherhost,machine=m2,boot=b2,plugin=rbd,since=1508127121")
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected Mount to fail on locked image")
+	assert.Equal(t, 0, len(fake.mapped), "Expected image not to be mapped")
+
+	// error tells who holds the lock
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "image rbd/foo is locked by host otherhost (machine m2, boot b2), plugin rbd (client.9999 at 10.0.0.9:0/9999) since 2017-10-16T04:12:01Z")
+		assert.Contains(t, err.Error(), "watched by client.7777 at 10.0.0.9:0/3524101")
+	}
+
+	// legacy hostname cookie, no watchers left
+	fake.image("rbd", "foo").locks[0].ID = "otherhost"
+	fake.image("rbd", "foo").watchers = nil
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "image rbd/foo is locked by host otherhost (client.9999 at 10.0.0.9:0/9999), no watchers")
+	}
+}
+
+func TestMount_waitForLock(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer func(initial, max time.Duration) {
+		lockWaitInitialBackoff, lockWaitMaxBackoff = initial, max
+	}(lockWaitInitialBackoff, lockWaitMaxBackoff)
+	lockWaitInitialBackoff, lockWaitMaxBackoff = 10*time.Millisecond, 20*time.Millisecond
+
+	fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+
+	// per-volume setting
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"lock-wait": "5s"}})
+	assert.Nil(t, err, formatError("Create", err))
+	assert.Equal(t, "5s", fake.image("rbd", "foo").meta["rbd-docker-plugin.lock-wait"])
+
+	// the other host lets go while we wait
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		fake.unlockFromOtherHost("rbd", "foo")
+	}()
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.True(t, fake.countCalls("rbd --pool rbd --conf  --id admin lock add foo") > 1, "Expected lock add to be retried")
+}
+
+func TestMount_waitForLockTimeout(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer func(initial time.Duration) { lockWaitInitialBackoff = initial }(lockWaitInitialBackoff)
+	lockWaitInitialBackoff = 10 * time.Millisecond
+	defer func(wait time.Duration) { *lockWait = wait }(*lockWait)
+	*lockWait = 50 * time.Millisecond
+
+	fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+
+	started := time.Now()
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected Mount to give up waiting")
+	assert.True(t, time.Since(started) >= 50*time.Millisecond, "Expected Mount to wait for the lock")
+	assert.Equal(t, 0, len(fake.mapped), "Expected image not to be mapped")
+}
+
+func TestCreate_invalidLockWait(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	fake.addImage("rbd", "foo", "xfs")
+
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"lock-wait": "soon"}})
+	assertErrorKind(t, KindInvalidOption, err)
+	assert.Equal(t, 0, len(fake.image("rbd", "foo").meta), "Expected no image-meta to be set")
+}
+
+func TestMount_dirtyFilesystem(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	img := fake.addImage("rbd", "foo", "xfs")
+	img.dirty = true
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected Mount to fail on dirty filesystem")
+	assert.Equal(t, 0, len(fake.mapped), "Expected image to be unmapped again")
+	assert.Equal(t, 0, len(fake.mounts), "Expected image not to be mounted")
+	assert.Equal(t, 0, len(img.locks), "Expected image to be unlocked again")
+}
+
+func TestUnmount_busyDevice(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	img := fake.addImage("rbd", "foo", "xfs")
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+
+	// still open in some container's mount namespace
+	img.inUse = true
+	err = d.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected Unmount to fail for busy device")
+	assert.Equal(t, 1, len(img.locks), "Expected image to stay locked while mapped")
+}
+
+func TestReconcile(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	fake.addImage("rbd", "foo", "xfs")
+	fake.addImage("rbd", "bar", "xfs")
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	_, err = d.Mount(&volume.MountRequest{Name: "bar", ID: "c2"})
+	assert.Nil(t, err, formatError("Mount", err))
+
+	// bar got unmounted behind our back, leaving it mapped and locked
+	_, err = fake.Run(context.Background(), "umount", fake.mappedDevice("rbd", "bar"))
+	assert.Nil(t, err, formatError("umount", err))
+
+	infoFile := filepath.Join(filepath.Dir(d.root), "mountinfo")
+	err = ioutil.WriteFile(infoFile, []byte(fake.mountInfo()), 0644)
+	assert.Nil(t, err, formatError("WriteFile", err))
+	defer func(orig string) { mountInfoPath = orig }(mountInfoPath)
+	mountInfoPath = infoFile
+
+	// restart: state file has both, reconcile only keeps mounted foo
+	restarted := newCephRBDVolumeDriver("test", "", "admin", "rbd", filepath.Dir(d.root), "", d.stateFile)
+	restarted.runner = fake
+	report, err := restarted.reconcile()
+	assert.Nil(t, err, formatError("reconcile", err))
+	assert.Equal(t, []string{"rbd/foo"}, report.Adopted)
+	assert.Equal(t, []string{"rbd/bar"}, report.MappedNotMounted)
+
+	vol, found := restarted.getVolume(restarted.mountpoint("rbd", "foo"))
+	if assert.True(t, found, "Expected foo to be adopted") {
+		assert.Equal(t, []string{"c1"}, vol.MountIDs)
+	}
+	_, found = restarted.getVolume(restarted.mountpoint("rbd", "bar"))
+	assert.False(t, found, "Expected bar to be dropped")
+
+	// and we can still unmount foo after the restart
+	err = restarted.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Equal(t, 0, len(fake.mounts), "Expected foo to be unmounted")
+	assert.Equal(t, 0, len(fake.image("rbd", "foo").locks), "Expected foo to be unlocked")
+}
+
+func TestReconcile_renamedHost(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	fake.addImage("rbd", "foo", "xfs")
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+
+	infoFile := filepath.Join(filepath.Dir(d.root), "mountinfo")
+	err = ioutil.WriteFile(infoFile, []byte(fake.mountInfo()), 0644)
+	assert.Nil(t, err, formatError("WriteFile", err))
+	defer func(orig string) { mountInfoPath = orig }(mountInfoPath)
+	mountInfoPath = infoFile
+
+	// restart without the state file, after the host got renamed
+	os.Remove(d.stateFile)
+	restarted := newCephRBDVolumeDriver("test", "", "admin", "rbd", filepath.Dir(d.root), "", d.stateFile)
+	restarted.runner = fake
+	restarted.cookie.Host = "renamed"
+	report, err := restarted.reconcile()
+	assert.Nil(t, err, formatError("reconcile", err))
+	assert.Equal(t, []string{"rbd/foo"}, report.Adopted)
+	assert.Equal(t, 0, len(report.MountedNotLocked), "Expected our lock under the old hostname to be found")
+
+	// the lock taken under the old name is still ours to release
+	vol, _ := restarted.getVolume(restarted.mountpoint("rbd", "foo"))
+	assert.Equal(t, fake.image("rbd", "foo").locks[0].ID, vol.Locker)
+	err = restarted.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Equal(t, 0, len(fake.image("rbd", "foo").locks), "Expected foo to be unlocked")
+}
+
+func TestReconcile_exclusiveWithoutState(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer func(mode lockMode) { lockModeFlag = mode }(lockModeFlag)
+	lockModeFlag = lockModeExclusive
+
+	img := fake.addImage("rbd", "foo", "xfs")
+	img.features = []string{"layering", "exclusive-lock"}
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+
+	infoFile := filepath.Join(filepath.Dir(d.root), "mountinfo")
+	err = ioutil.WriteFile(infoFile, []byte(fake.mountInfo()), 0644)
+	assert.Nil(t, err, formatError("WriteFile", err))
+	defer func(orig string) { mountInfoPath = orig }(mountInfoPath)
+	mountInfoPath = infoFile
+
+	// restart without the state file: the kernel client's lock is no orphan
+	os.Remove(d.stateFile)
+	restarted := newCephRBDVolumeDriver("test", "", "admin", "rbd", filepath.Dir(d.root), "", d.stateFile)
+	restarted.runner = fake
+	report, err := restarted.reconcile()
+	assert.Nil(t, err, formatError("reconcile", err))
+	assert.Equal(t, []string{"rbd/foo"}, report.Adopted)
+	assert.Equal(t, 0, len(report.MountedNotLocked), "Expected exclusive lock to be recognized")
+
+	vol, _ := restarted.getVolume(restarted.mountpoint("rbd", "foo"))
+	assert.Equal(t, lockModeExclusive, vol.LockMode)
+	err = restarted.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Equal(t, 0, fake.countCalls("rbd --pool rbd --conf  --id admin lock rm"), "Expected no advisory unlock")
+	assert.Equal(t, 0, len(fake.image("rbd", "foo").locks), "Expected the unmap to release the lock")
 }
 
 // cephRBDDriver.parseImagePoolNameSize(string) (string, string, int, error)
@@ -113,7 +551,7 @@ func TestParseImagePoolNameSize_withPoolAndSize(t *testing.T) {
 // Error response when built with golang 1.6: 400 Bad Request: missing required Host header
 func TestSocketActivate(t *testing.T) {
 	t.Skip("This test requires socket, which seems to need root privs to build. So this test fails if run as normal user. TODO: Find a proper workaround.")
-	out, err := sh("bash", "-c", "echo \"POST /Plugin.Activate HTTP/1.1\r\n\" | sudo socat unix-connect:/tmp/rbd-test.sock STDIO")
+	out, err := testDriver.sh("bash", "-c", "echo \"POST /Plugin.Activate HTTP/1.1\r\n\" | sudo socat unix-connect:/tmp/rbd-test.sock STDIO")
 	assert.Nil(t, err, formatError("socat plugin activate", err))
 	assert.Contains(t, out, EXPECTED_ACTIVATION_RESPONSE, "Expecting Implements VolumeDriver message")
 
@@ -129,3 +567,270 @@ func parseImageAndHandleError(t *testing.T, name string) (string, string, int) {
 	assert.Nil(t, err, formatError("parseImagePoolNameSize", err))
 	return pool, name, size
 }
+
+func TestVolumeLifecycle_exclusiveLock(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer func(mode lockMode, create bool) { lockModeFlag, *canCreateVolumes = mode, create }(lockModeFlag, *canCreateVolumes)
+	lockModeFlag, *canCreateVolumes = lockModeExclusive, true
+
+	err := d.Create(&volume.CreateRequest{Name: "foo"})
+	assert.Nil(t, err, formatError("Create", err))
+	img := fake.image("rbd", "foo")
+	assert.Equal(t, []string{"layering", "exclusive-lock"}, img.features)
+	assert.Equal(t, 0, fake.countCalls("rbd --pool rbd --conf  --id admin lock add"), "Expected no advisory lock")
+
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, 2, fake.countCalls("rbd --pool rbd --conf  --id admin map foo --options exclusive"), "Expected exclusive map for mkfs and Mount")
+	vol, _ := d.getVolume(d.mountpoint("rbd", "foo"))
+	assert.Equal(t, lockModeExclusive, vol.LockMode)
+	if assert.Equal(t, 1, len(img.locks)) {
+		assert.Equal(t, "auto 18446462598732840961", img.locks[0].ID, "Expected kernel client to hold the lock")
+		assert.Equal(t, img.locks[0].ID, vol.Locker, "Expected the managed lock cookie")
+	}
+
+	err = d.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Equal(t, 0, len(img.locks), "Expected lock to go with the unmap")
+	assert.Equal(t, 0, fake.countCalls("rbd --pool rbd --conf  --id admin lock rm"), "Expected no advisory unlock")
+}
+
+func TestMount_exclusiveLockFallback(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer func(mode lockMode) { lockModeFlag = mode }(lockModeFlag)
+	lockModeFlag = lockModeExclusive
+
+	// older image without the feature: advisory lock as before
+	fake.addImage("rbd", "foo", "xfs")
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	vol, _ := d.getVolume(d.mountpoint("rbd", "foo"))
+	assert.Equal(t, lockModeAdvisory, vol.LockMode)
+	assert.True(t, d.cookie.sameInstance(parseLockCookie(vol.Locker)), "Expected our advisory lock")
+	assert.Equal(t, 1, fake.countCalls("rbd --pool rbd --conf  --id admin lock add foo"))
+}
+
+func TestMount_exclusiveLockedByOtherHost(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer func(mode lockMode) { lockModeFlag = mode }(lockModeFlag)
+	lockModeFlag = lockModeExclusive
+
+	img := fake.addImage("rbd", "foo", "xfs")
+	img.features = []string{"layering", "exclusive-lock"}
+	img.locks = []rbdLock{{ID: "auto 139643345791728", Locker: "client.9999", Address: "10.0.0.9:0/9999"}}
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	if assert.NotNil(t, err, "Expected Mount to fail on locked image") {
+		assert.Contains(t, err.Error(), "image rbd/foo is locked by exclusive-lock owner (client.9999 at 10.0.0.9:0/9999)")
+	}
+	assert.Equal(t, 0, len(fake.mapped), "Expected image not to be mapped")
+}
+
+func TestCreate_exclusiveMappedElsewhere(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	// the kernel client of another host holds the exclusive lock
+	img := fake.addImage("rbd", "foo", "xfs")
+	img.features = []string{"layering", "exclusive-lock"}
+	img.locks = []rbdLock{{ID: "auto 139643345791728", Locker: "client.9999", Address: "10.0.0.9:0/9999"}}
+
+	err := d.Create(&volume.CreateRequest{Name: "foo@2048"})
+	assertErrorKind(t, KindBusy, err)
+	if err != nil {
+		assert.Contains(t, err.Error(), "mapped with the exclusive lock, held by exclusive-lock owner (client.9999 at 10.0.0.9:0/9999)")
+	}
+	assert.Equal(t, 1024, img.size, "Expected image not to be resized")
+
+	err = d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"lock-wait": "1m"}})
+	assertErrorKind(t, KindBusy, err)
+	assert.Equal(t, 0, len(img.meta), "Expected no image-meta to be set")
+
+	// nothing to change: fine while mapped
+	err = d.Create(&volume.CreateRequest{Name: "foo@1024"})
+	assert.Nil(t, err, formatError("Create", err))
+
+	img.locks = nil
+	err = d.Create(&volume.CreateRequest{Name: "foo@2048", Options: map[string]string{"lock-wait": "1m"}})
+	assert.Nil(t, err, formatError("Create", err))
+	assert.Equal(t, 2048, img.size)
+	value, _ := fake.imageMetaValue("rbd", "foo", imageMetaPrefix+metaLockWait)
+	assert.Equal(t, "1m", value)
+}
+
+func TestLockModeFlag(t *testing.T) {
+	var mode lockMode
+	assert.Nil(t, mode.Set("exclusive"))
+	assert.Equal(t, lockModeExclusive, mode.String())
+	assert.NotNil(t, mode.Set("mandatory"), "Expected invalid lock mode to be refused")
+}
+
+func TestVolumeLifecycle_readOnly(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	img := fake.addImage("rbd", "foo", "xfs")
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"access": "ro"}})
+	assert.Nil(t, err, formatError("Create", err))
+	value, _ := fake.imageMetaValue("rbd", "foo", imageMetaPrefix+metaAccess)
+	assert.Equal(t, "ro", value)
+
+	// dirty log of the last writer: no repair, mounted without recovery
+	img.dirty = true
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	mount := d.mountpoint("rbd", "foo")
+	assert.Equal(t, 1, fake.countCalls("rbd --pool rbd --conf  --id admin map foo --read-only"), "Expected read-only map")
+	assert.Equal(t, "ro,norecovery", fake.options[mount])
+	assert.Equal(t, 0, fake.countCalls("xfs_repair"), "Expected no filesystem check")
+	assert.Equal(t, 0, len(img.locks), "Expected no lock")
+	_, ok := fake.imageMetaValue("rbd", "foo", imageMetaPrefix+metaHeartbeat)
+	assert.False(t, ok, "Expected no heartbeat")
+	vol, _ := d.getVolume(mount)
+	assert.True(t, vol.ReadOnly)
+
+	err = d.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Equal(t, 0, len(fake.mapped), "Expected volume to be unmapped")
+	assert.Equal(t, 0, fake.countCalls("rbd --pool rbd --conf  --id admin lock add"), "Expected no lock add")
+	assert.Equal(t, 0, fake.countCalls("rbd --pool rbd --conf  --id admin lock rm"), "Expected no lock rm")
+}
+
+func TestMount_readOnlyMetaUnreadable(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	img := fake.addImage("rbd", "foo", "xfs")
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"access": "ro"}})
+	assert.Nil(t, err, formatError("Create", err))
+
+	// can't tell if it's read-only: don't take the lock and map it read-write
+	img.metaErr = true
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assertErrorKind(t, KindInternal, err)
+	assert.Equal(t, 0, len(img.locks), "Expected no lock")
+	assert.Equal(t, 0, len(fake.mapped), "Expected nothing mapped")
+}
+
+func TestMount_noImageMeta(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	// rbd without image-meta: no per-volume settings, just the defaults
+	fake.noImageMeta = true
+	img := fake.addImage("rbd", "foo", "xfs")
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, 1, len(img.locks), "Expected our advisory lock")
+
+	err = d.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Equal(t, 0, len(img.locks), "Expected lock to be released")
+}
+
+func TestMount_readOnlyLockedByWriter(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	fake.addImage("rbd", "foo", "ext4")
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"access": "ro"}})
+	assert.Nil(t, err, formatError("Create", err))
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	if assert.NotNil(t, err, "Expected read-only Mount to fail while a writer holds the lock") {
+		assert.Contains(t, err.Error(), "image rbd/foo is locked by host otherhost")
+	}
+	assert.Equal(t, 0, len(fake.mapped), "Expected image not to be mapped")
+
+	fake.unlockFromOtherHost("rbd", "foo")
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, "ro,noload", fake.options[d.mountpoint("rbd", "foo")])
+}
+
+func TestCreate_invalidAccess(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	fake.addImage("rbd", "foo", "xfs")
+
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"access": "shared"}})
+	assertErrorKind(t, KindInvalidOption, err)
+	assert.Equal(t, 0, len(fake.image("rbd", "foo").meta), "Expected no image-meta to be set")
+}
+
+func TestCreate_accessChangeWhileMapped(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	img := fake.addImage("rbd", "foo", "xfs")
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"access": "ro"}})
+	assert.Nil(t, err, formatError("Create", err))
+
+	// a reader on another host: it must not end up sharing the image with a writer
+	img.watchers = []rbdWatcher{{Client: 7777, Address: "10.0.0.9:0/3524101", Cookie: 1}}
+	err = d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"access": "rw"}})
+	assertErrorKind(t, KindBusy, err)
+	if err != nil {
+		assert.Contains(t, err.Error(), "watched by client.7777 at 10.0.0.9:0/3524101")
+	}
+	value, _ := fake.imageMetaValue("rbd", "foo", imageMetaPrefix+metaAccess)
+	assert.Equal(t, "ro", value, "Expected access to stay read-only")
+
+	// no change asked for: fine while mapped
+	err = d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"access": "ro"}})
+	assert.Nil(t, err, formatError("Create", err))
+
+	img.watchers = nil
+	err = d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"access": "rw"}})
+	assert.Nil(t, err, formatError("Create", err))
+	value, _ = fake.imageMetaValue("rbd", "foo", imageMetaPrefix+metaAccess)
+	assert.Equal(t, "rw", value)
+}
+
+func TestCreate_growUnmounted(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	img := fake.addImage("rbd", "foo", "ext4")
+
+	// no size asked for: leave it alone
+	err := d.Create(&volume.CreateRequest{Name: "foo"})
+	assert.Nil(t, err, formatError("Create", err))
+	assert.Equal(t, 1024, img.size)
+
+	err = d.Create(&volume.CreateRequest{Name: "foo@2048"})
+	assert.Nil(t, err, formatError("Create", err))
+	assert.Equal(t, 2048, img.size)
+	assert.Equal(t, 1024, img.fsSize, "Expected filesystem to grow on Mount")
+
+	// never shrink
+	err = d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"size": "512"}})
+	assert.Nil(t, err, formatError("Create", err))
+	assert.Equal(t, 2048, img.size)
+
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, 2048, img.fsSize, "Expected filesystem to be grown")
+	assert.Equal(t, 1, fake.countCalls("resize2fs /dev/rbd0"))
+	_, pending := fake.imageMetaValue("rbd", "foo", imageMetaPrefix+metaGrowFilesystem)
+	assert.False(t, pending, "Expected pending growth to be cleared")
+}
+
+func TestCreate_growMounted(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	img := fake.addImage("rbd", "foo", "xfs")
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+
+	err = d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"size": "4096"}})
+	assert.Nil(t, err, formatError("Create", err))
+	assert.Equal(t, 4096, img.size)
+	assert.Equal(t, 4096, img.fsSize, "Expected filesystem to be grown online")
+	assert.Equal(t, 1, fake.countCalls("xfs_growfs "+d.mountpoint("rbd", "foo")))
+	_, pending := fake.imageMetaValue("rbd", "foo", imageMetaPrefix+metaGrowFilesystem)
+	assert.False(t, pending, "Expected no pending growth")
+}
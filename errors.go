@@ -0,0 +1,98 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Typed errors for VolumeDriver responses. Docker passes on only the error
+// message, so each starts with the stable name of its kind, e.g.
+//
+//	Locked: Unable to get Exclusive Lock: image rbd/foo is locked by host node2 (...)
+//
+// for orchestration tooling to match on (retry on Locked or Busy, alert on
+// FilesystemCorrupt, ...).
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ErrorKind is the class of a VolumeError, and the prefix of its message
+type ErrorKind string
+
+const (
+	KindNotFound           ErrorKind = "NotFound"           // image (or pool) does not exist
+	KindLocked             ErrorKind = "Locked"             // image is locked by another host or writer
+	KindBusy               ErrorKind = "Busy"               // device still in use, e.g. open in a container
+	KindClusterUnavailable ErrorKind = "ClusterUnavailable" // ceph can't be reached, see cephBreaker
+	KindFilesystemCorrupt  ErrorKind = "FilesystemCorrupt"  // filesystem has errors, needs repairs
+	KindInvalidName        ErrorKind = "InvalidName"        // volume name can't be parsed
+	KindInvalidOption      ErrorKind = "InvalidOption"      // create option value not valid, e.g. lock-wait=soon
+	KindPolicyDenied       ErrorKind = "PolicyDenied"       // not allowed by plugin configuration, e.g. no --create
+	KindTimeout            ErrorKind = "Timeout"            // command killed after its timeout
+	KindInternal           ErrorKind = "Internal"           // anything else, e.g. mkfs or mount failing
+)
+
+// VolumeError is an error returned by the VolumeDriver API methods
+type VolumeError struct {
+	Kind  ErrorKind
+	Msg   string
+	Cause error // underlying error, if any
+}
+
+func (e VolumeError) Error() string {
+	msg := string(e.Kind) + ": " + e.Msg
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+// newVolumeError builds an error of the given kind, cause may be nil
+func newVolumeError(kind ErrorKind, cause error, format string, args ...interface{}) VolumeError {
+	return VolumeError{Kind: kind, Msg: fmt.Sprintf(format, args...), Cause: cause}
+}
+
+// wrapVolumeError builds an error of the kind of its cause, see errorKindOf
+func wrapVolumeError(cause error, format string, args ...interface{}) VolumeError {
+	return newVolumeError(errorKindOf(cause), cause, format, args...)
+}
+
+// errorKindOf classifies an error from the driver internals. Callers that
+// know better (e.g. EBUSY from lock add means Locked, from unmap Busy) use
+// newVolumeError instead.
+func errorKindOf(err error) ErrorKind {
+	switch e := err.(type) {
+	case VolumeError:
+		return e.Kind
+	case CephUnavailableError:
+		return KindClusterUnavailable
+	case ShTimeoutError:
+		return KindTimeout
+	}
+	switch {
+	case isCephConnectionError(err):
+		return KindClusterUnavailable
+	case isExitCode(err, syscall.ENOENT) && isRBDCommand(err):
+		return KindNotFound
+	}
+	return KindInternal
+}
+
+// isRBDCommand checks if a command error is from rbd, which exits with an
+// errno (other commands have exit codes of their own, e.g. mount(8))
+func isRBDCommand(err error) bool {
+	cmdErr, ok := err.(CmdError)
+	if !ok {
+		return false
+	}
+	fields := strings.Fields(cmdErr.Command)
+	return len(fields) > 0 && filepath.Base(fields[0]) == "rbd"
+}
+
+// isErrorKind checks if err is a VolumeError of the given kind
+func isErrorKind(err error, kind ErrorKind) bool {
+	e, ok := err.(VolumeError)
+	return ok && e.Kind == kind
+}
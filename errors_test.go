@@ -0,0 +1,87 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+)
+
+// assertErrorKind checks the kind and the message prefix tooling matches on
+func assertErrorKind(t *testing.T, kind ErrorKind, err error) {
+	if assert.NotNil(t, err, "Expected %s error", kind) {
+		assert.True(t, isErrorKind(err, kind), "Expected %s error, got: %s", kind, err)
+		assert.True(t, strings.HasPrefix(err.Error(), string(kind)+": "), "Expected %s prefix: %s", kind, err)
+	}
+}
+
+func TestVolumeError(t *testing.T) {
+	err := newVolumeError(KindLocked, errors.New("lock add failed"), "Unable to lock %s", "foo")
+	assert.Equal(t, "Locked: Unable to lock foo: lock add failed", err.Error())
+	err = newVolumeError(KindNotFound, nil, "no %s", "foo")
+	assert.Equal(t, "NotFound: no foo", err.Error())
+}
+
+func TestErrorKindOf(t *testing.T) {
+	assert.Equal(t, KindTimeout, errorKindOf(ShTimeoutError{Command: "rbd ls"}))
+	assert.Equal(t, KindClusterUnavailable, errorKindOf(CephUnavailableError{}))
+	assert.Equal(t, KindClusterUnavailable, errorKindOf(CmdError{Command: "rbd ls", ExitCode: 110}))
+	assert.Equal(t, KindNotFound, errorKindOf(CmdError{Command: "rbd info foo", ExitCode: 2}))
+	assert.Equal(t, KindInternal, errorKindOf(CmdError{Command: "mount -t xfs /dev/rbd0 /mnt", ExitCode: 2}))
+	assert.Equal(t, KindBusy, errorKindOf(newVolumeError(KindBusy, nil, "busy")))
+	assert.Equal(t, KindInternal, errorKindOf(errors.New("oops")))
+}
+
+func TestAPIErrorKinds(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	_, err := d.Mount(&volume.MountRequest{Name: "bad name!", ID: "c1"})
+	assertErrorKind(t, KindInvalidName, err)
+	_, err = d.Path(&volume.PathRequest{Name: "bad name!"})
+	assertErrorKind(t, KindInvalidName, err)
+	err = d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"lock-wait": "soon"}})
+	assertErrorKind(t, KindInvalidOption, err)
+
+	err = d.Create(&volume.CreateRequest{Name: "foo"})
+	assertErrorKind(t, KindPolicyDenied, err)
+	_, err = d.Get(&volume.GetRequest{Name: "foo"})
+	assertErrorKind(t, KindNotFound, err)
+	err = d.Remove(&volume.RemoveRequest{Name: "foo"})
+	assertErrorKind(t, KindNotFound, err)
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assertErrorKind(t, KindNotFound, err)
+
+	img := fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assertErrorKind(t, KindLocked, err)
+	err = d.Remove(&volume.RemoveRequest{Name: "foo"})
+	assertErrorKind(t, KindLocked, err)
+	fake.unlockFromOtherHost("rbd", "foo")
+
+	img.dirty = true
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assertErrorKind(t, KindFilesystemCorrupt, err)
+	img.dirty = false
+
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	img.inUse = true
+	err = d.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assertErrorKind(t, KindBusy, err)
+
+	fake.setDown(true)
+	for i := 0; i < *cephFailures; i++ {
+		d.Get(&volume.GetRequest{Name: "foo"})
+	}
+	_, err = d.Get(&volume.GetRequest{Name: "foo"})
+	assertErrorKind(t, KindClusterUnavailable, err)
+	_, err = d.List()
+	assertErrorKind(t, KindClusterUnavailable, err)
+}
@@ -0,0 +1,639 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// in-memory fake of rbd and the other commands the driver calls, so we can
+// test the whole VolumeDriver lifecycle without a ceph cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeExitError looks like the error from a command exiting non-zero, Run
+// fills in the command
+func fakeExitError(code int) error {
+	return CmdError{ExitCode: code}
+}
+
+// fakeJSON renders v like `rbd --format json` of nautilus
+func fakeJSON(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+type fakeImage struct {
+	size     int
+	fstype   string // set by mkfs
+	fsSize   int    // filesystem size (MB), set by mkfs and grown by xfs_growfs/resize2fs
+	dirty    bool   // fs check (xfs_repair -n, e2fsck -n, btrfs check) reports errors, cleared by a repair
+	inUse    bool   // device still open elsewhere, unmap fails with EBUSY
+	locks    []rbdLock
+	watchers []rbdWatcher // watchers on other hosts
+	meta     map[string]string
+	metaErr  bool     // image-meta list fails with EIO
+	features []string // nil: layering only
+}
+
+// exclusiveHeld tells if a kernel client holds the exclusive lock: it keeps it
+// while mapped, so writes needing the lock (image-meta, resize) are refused
+func (img *fakeImage) exclusiveHeld() bool {
+	for _, l := range img.locks {
+		if strings.HasPrefix(l.ID, exclusiveLockCookiePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeRBD simulates images, locks, kernel mappings and mounts of one host
+type fakeRBD struct {
+	m       sync.Mutex
+	images  map[string]*fakeImage // key: pool/image
+	mapped  map[string]string     // device => pool/image
+	mounts  map[string]string     // mountpoint => device
+	options map[string]string     // mountpoint => mount options
+	client  string                // our ceph client id
+	address string                // our ceph client address
+	calls   []string
+	down    bool // cluster unreachable: rbd fails talking to the monitors
+
+	blocklist   []string // fenced client addresses
+	noBlocklist bool     // pre-pacific ceph: only knows `osd blacklist`
+	noImageMeta bool     // pre-infernalis rbd: no image-meta command
+}
+
+func newFakeRBD() *fakeRBD {
+	return &fakeRBD{
+		images:  map[string]*fakeImage{},
+		mapped:  map[string]string{},
+		mounts:  map[string]string{},
+		options: map[string]string{},
+		client:  "client.4123",
+		address: "10.0.0.5:0/1234",
+	}
+}
+
+// newFakeDriver returns a driver using the fake with temp mount root and
+// state file, call cleanup when done
+func newFakeDriver(t *testing.T) (cephRBDVolumeDriver, *fakeRBD, func()) {
+	dir, err := ioutil.TempDir("", "rbd-fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeRBD()
+	d := newCephRBDVolumeDriver("test", "", "admin", "rbd", dir, "", filepath.Join(dir, "volumes.json"))
+	d.runner = fake
+	d.localAddrs = func() ([]string, error) { return []string{"10.0.0.5"}, nil }
+	return d, fake, func() { os.RemoveAll(dir) }
+}
+
+// addImage creates an image with a filesystem, as if created by hand
+func (f *fakeRBD) addImage(pool, name, fstype string) *fakeImage {
+	f.m.Lock()
+	defer f.m.Unlock()
+	img := &fakeImage{size: 1024, fstype: fstype, fsSize: 1024}
+	f.images[pool+"/"+name] = img
+	return img
+}
+
+// lockFromOtherHost adds a lock held by another host: taken by its rbd lock
+// add command, watched by its kernel client (another client and nonce)
+func (f *fakeRBD) lockFromOtherHost(pool, name, cookie string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	img := f.images[pool+"/"+name]
+	img.locks = append(img.locks, rbdLock{Locker: "client.9999", ID: cookie, Address: "10.0.0.9:0/9999"})
+	img.watchers = append(img.watchers, rbdWatcher{Client: 7777, Address: "10.0.0.9:0/3524101", Cookie: 1})
+}
+
+// heartbeatFromOtherHost sets the lease of the other host's lock
+func (f *fakeRBD) heartbeatFromOtherHost(pool, name, cookie string, leaseExpires time.Time) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	img := f.images[pool+"/"+name]
+	if img.meta == nil {
+		img.meta = map[string]string{}
+	}
+	img.meta[imageMetaPrefix+metaHeartbeat] = fakeJSON(lockHeartbeat{
+		Host:         "host otherhost",
+		Lock:         cookie,
+		Client:       "10.0.0.9:0/3524101",
+		Time:         leaseExpires.Add(-2 * time.Minute),
+		LeaseExpires: leaseExpires,
+	})
+}
+
+// imageMetaValue returns an image-meta value of the image
+func (f *fakeRBD) imageMetaValue(pool, name, key string) (string, bool) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	value, ok := f.images[pool+"/"+name].meta[key]
+	return value, ok
+}
+
+// setDown makes the cluster unreachable, or reachable again
+func (f *fakeRBD) setDown(down bool) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.down = down
+}
+
+// unlockFromOtherHost drops the locks and watchers of the other host
+func (f *fakeRBD) unlockFromOtherHost(pool, name string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	img := f.images[pool+"/"+name]
+	img.locks = nil
+	img.watchers = nil
+}
+
+func (f *fakeRBD) image(pool, name string) *fakeImage {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.images[pool+"/"+name]
+}
+
+// mappedDevice returns the kernel device the image is mapped to
+func (f *fakeRBD) mappedDevice(pool, name string) string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for dev, key := range f.mapped {
+		if key == pool+"/"+name {
+			return dev
+		}
+	}
+	return ""
+}
+
+// countCalls counts the calls that start with the given command line
+func (f *fakeRBD) countCalls(prefix string) int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	n := 0
+	for _, call := range f.calls {
+		if strings.HasPrefix(call, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// mountInfo renders the fake mounts in /proc/self/mountinfo format
+func (f *fakeRBD) mountInfo() string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	var b bytes.Buffer
+	b.WriteString("22 1 253:0 / / rw,relatime shared:1 - xfs /dev/mapper/root rw\n")
+	i := 0
+	for dir, dev := range f.mounts {
+		img := f.images[f.mapped[dev]]
+		fmt.Fprintf(&b, "%d 22 252:%d / %s rw,relatime - %s %s rw\n", 40+i, i*16, dir, img.fstype, dev)
+		i++
+	}
+	return b.String()
+}
+
+func (f *fakeRBD) LookPath(file string) (string, error) {
+	switch file {
+	case "mkfs.xfs", "mkfs.ext4", "mkfs.btrfs":
+		return "/sbin/" + file, nil
+	}
+	return "", fmt.Errorf("exec: %q: executable file not found in $PATH", file)
+}
+
+func (f *fakeRBD) Run(ctx context.Context, name string, args ...string) (string, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	call := strings.Join(append([]string{filepath.Base(name)}, args...), " ")
+	f.calls = append(f.calls, call)
+
+	out, err := f.run(name, args)
+	if cmdErr, ok := err.(CmdError); ok {
+		cmdErr.Command = call
+		err = cmdErr
+	}
+	return out, err
+}
+
+func (f *fakeRBD) run(name string, args []string) (string, error) {
+	switch filepath.Base(name) {
+	case "rbd":
+		if f.down && !contains(args, "unmap") && !contains(args, "showmapped") {
+			return "", CmdError{ExitCode: 110, Stderr: "rbd: couldn't connect to the cluster!"}
+		}
+		return f.rbd(args)
+	case "ceph":
+		// ceph --conf c --id user osd blocklist add ADDR
+		args = args[4:]
+		if len(args) == 4 && args[0] == "osd" && args[2] == "add" {
+			if args[1] == "blacklist" || (args[1] == "blocklist" && !f.noBlocklist) {
+				f.blocklist = append(f.blocklist, args[3])
+				return "", nil
+			}
+		}
+		return "", fakeExitError(22)
+	case "blkid":
+		img := f.images[f.mapped[args[len(args)-1]]]
+		if img == nil || img.fstype == "" {
+			return "", fakeExitError(2)
+		}
+		return img.fstype, nil
+	case "xfs_repair":
+		// xfs_repair [-n] device
+		img := f.images[f.mapped[args[len(args)-1]]]
+		if img == nil || img.fstype != "xfs" {
+			return "", fakeExitError(1)
+		}
+		if args[0] != "-n" {
+			img.dirty = false
+		}
+		if img.dirty {
+			return "", fakeExitError(1)
+		}
+		return "", nil
+	case "e2fsck":
+		// e2fsck -n|-p device
+		img := f.images[f.mapped[args[len(args)-1]]]
+		if img == nil || !strings.HasPrefix(img.fstype, "ext") {
+			return "", fakeExitError(8)
+		}
+		if img.dirty && args[0] == "-p" {
+			img.dirty = false
+			return "", fakeExitError(1)
+		}
+		if img.dirty {
+			return "", fakeExitError(4)
+		}
+		return "", nil
+	case "mount":
+		// mount -t fstype [-o options] device dir
+		fstype, options := args[1], ""
+		if args[2] == "-o" {
+			options = args[3]
+		}
+		dev, dir := args[len(args)-2], args[len(args)-1]
+		img := f.images[f.mapped[dev]]
+		if img == nil || img.fstype != fstype {
+			return "", fakeExitError(32)
+		}
+		f.mounts[dir] = dev
+		f.options[dir] = options
+		return "", nil
+	case "blockdev":
+		// blockdev --getsize64 device
+		img := f.images[f.mapped[args[1]]]
+		if img == nil {
+			return "", fakeExitError(1)
+		}
+		return fmt.Sprintf("%d", uint64(img.size)<<20), nil
+	case "xfs_info":
+		img := f.images[f.mapped[f.mounts[args[0]]]]
+		if img == nil || img.fstype != "xfs" {
+			return "", fakeExitError(1)
+		}
+		return fmt.Sprintf("meta-data=%s isize=512 agcount=4, agsize=65536 blks\n"+
+			"data     =                       bsize=4096   blocks=%d, imaxpct=25\n"+
+			"log      =internal log           bsize=4096   blocks=2560, version=2", f.mounts[args[0]], img.fsSize<<8), nil
+	case "dumpe2fs":
+		img := f.images[f.mapped[args[1]]]
+		if img == nil || !strings.HasPrefix(img.fstype, "ext") {
+			return "", fakeExitError(1)
+		}
+		return fmt.Sprintf("Filesystem volume name:   <none>\nBlock count:              %d\nBlock size:               4096", img.fsSize<<8), nil
+	case "btrfs":
+		// btrfs check --readonly device
+		if args[0] == "check" {
+			img := f.images[f.mapped[args[len(args)-1]]]
+			if img == nil || img.fstype != "btrfs" || img.dirty {
+				return "", fakeExitError(1)
+			}
+			return "", nil
+		}
+		// btrfs filesystem show --raw dir, btrfs filesystem resize max dir
+		img := f.images[f.mapped[f.mounts[args[len(args)-1]]]]
+		if img == nil || img.fstype != "btrfs" {
+			return "", fakeExitError(1)
+		}
+		if args[1] == "resize" {
+			img.fsSize = img.size
+			return "", nil
+		}
+		return fmt.Sprintf("Label: none  uuid: 0b1a\n\tTotal devices 1 FS bytes used 114688\n\tdevid    1 size %d used 228589568 path %s",
+			uint64(img.fsSize)<<20, f.mounts[args[len(args)-1]]), nil
+	case "xfs_growfs":
+		img := f.images[f.mapped[f.mounts[args[0]]]]
+		if img == nil || img.fstype != "xfs" {
+			return "", fakeExitError(1)
+		}
+		img.fsSize = img.size
+		return "", nil
+	case "resize2fs":
+		img := f.images[f.mapped[args[0]]]
+		if img == nil || !strings.HasPrefix(img.fstype, "ext") {
+			return "", fakeExitError(1)
+		}
+		img.fsSize = img.size
+		return "", nil
+	case "umount":
+		for dir, dev := range f.mounts {
+			if dev == args[0] || dir == args[0] {
+				delete(f.mounts, dir)
+				delete(f.options, dir)
+				return "", nil
+			}
+		}
+		return "", fakeExitError(32)
+	}
+
+	if strings.HasPrefix(filepath.Base(name), "mkfs.") {
+		img := f.images[f.mapped[args[len(args)-1]]]
+		if img == nil {
+			return "", fakeExitError(1)
+		}
+		img.fstype = strings.TrimPrefix(filepath.Base(name), "mkfs.")
+		img.fsSize = img.size
+		return "", nil
+	}
+
+	return "", fmt.Errorf("exec: %q: executable file not found in $PATH", name)
+}
+
+func (f *fakeRBD) rbd(args []string) (string, error) {
+	// pull out global flags
+	pool := ""
+	rest := []string{}
+	opts := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--read-only" {
+			opts[args[i]] = "true"
+			continue
+		}
+		if strings.HasPrefix(args[i], "--") && i+1 < len(args) {
+			opts[args[i]] = args[i+1]
+			i++
+			continue
+		}
+		rest = append(rest, args[i])
+	}
+	pool = opts["--pool"]
+	if len(rest) == 0 {
+		return "", fakeExitError(22)
+	}
+	cmd, rest := rest[0], rest[1:]
+
+	imageArg := func(i int) (string, *fakeImage) {
+		if len(rest) <= i {
+			return "", nil
+		}
+		key := pool + "/" + rest[i]
+		return key, f.images[key]
+	}
+
+	switch cmd {
+	case "ls":
+		images := []rbdImage{}
+		for key, img := range f.images {
+			if strings.HasPrefix(key, pool+"/") {
+				images = append(images, rbdImage{Image: strings.TrimPrefix(key, pool+"/"), Size: uint64(img.size) << 20, Format: 2})
+			}
+		}
+		sort.Slice(images, func(i, j int) bool { return images[i].Image < images[j].Image })
+		return fakeJSON(images), nil
+
+	case "info":
+		_, img := imageArg(0)
+		if img == nil {
+			return "", fakeExitError(2)
+		}
+		features := img.features
+		if features == nil {
+			features = []string{"layering"}
+		}
+		return fakeJSON(rbdImageInfo{Name: rest[0], Size: uint64(img.size) << 20, Format: 2, Features: features}), nil
+
+	case "create":
+		key, img := imageArg(0)
+		if img != nil {
+			return "", fakeExitError(17)
+		}
+		size := 0
+		fmt.Sscanf(opts["--size"], "%d", &size)
+		img = &fakeImage{size: size}
+		if opts["--image-feature"] != "" {
+			img.features = strings.Split(opts["--image-feature"], ",")
+		}
+		f.images[key] = img
+		return "", nil
+
+	case "resize":
+		_, img := imageArg(0)
+		if img == nil {
+			return "", fakeExitError(2)
+		}
+		size := 0
+		fmt.Sscanf(opts["--size"], "%d", &size)
+		// we never pass --allow-shrink
+		if size < img.size {
+			return "", fakeExitError(22)
+		}
+		if img.exclusiveHeld() {
+			return "", fakeExitError(int(syscall.EROFS))
+		}
+		img.size = size
+		return "", nil
+
+	case "rm":
+		key, img := imageArg(0)
+		if img == nil {
+			return "", fakeExitError(2)
+		}
+		delete(f.images, key)
+		return "", nil
+
+	case "rename":
+		key, img := imageArg(0)
+		if img == nil {
+			return "", fakeExitError(2)
+		}
+		delete(f.images, key)
+		f.images[pool+"/"+rest[1]] = img
+		return "", nil
+
+	case "lock":
+		sub := rest[0]
+		rest = rest[1:]
+		_, img := imageArg(0)
+		if img == nil {
+			return "", fakeExitError(2)
+		}
+		switch sub {
+		case "add":
+			if len(img.locks) > 0 {
+				return "", fakeExitError(16)
+			}
+			img.locks = append(img.locks, rbdLock{Locker: f.client, ID: rest[1], Address: f.address})
+			return "", nil
+		case "list", "ls":
+			return fakeJSON(img.locks), nil
+		case "rm":
+			for i, l := range img.locks {
+				if l.ID == rest[1] && l.Locker == rest[2] {
+					img.locks = append(img.locks[:i], img.locks[i+1:]...)
+					return "", nil
+				}
+			}
+			return "", fakeExitError(2)
+		}
+
+	case "status":
+		key, img := imageArg(0)
+		if img == nil {
+			return "", fakeExitError(2)
+		}
+		watchers := append([]rbdWatcher{}, img.watchers...)
+		for _, mkey := range f.mapped {
+			if mkey == key {
+				watchers = append(watchers, rbdWatcher{Client: 4123, Address: f.address, Cookie: 1})
+			}
+		}
+		return fakeJSON(map[string][]rbdWatcher{"watchers": watchers}), nil
+
+	case "image-meta":
+		if f.noImageMeta {
+			return "", CmdError{ExitCode: 1, Stderr: "rbd: error parsing command 'image-meta'; -h or --help for usage"}
+		}
+		sub := rest[0]
+		rest = rest[1:]
+		_, img := imageArg(0)
+		if img == nil {
+			return "", fakeExitError(2)
+		}
+		switch sub {
+		case "list":
+			if img.metaErr {
+				return "", fakeExitError(int(syscall.EIO))
+			}
+			return fakeJSON(img.meta), nil
+		case "set":
+			if img.exclusiveHeld() {
+				return "", fakeExitError(int(syscall.EROFS))
+			}
+			if img.meta == nil {
+				img.meta = map[string]string{}
+			}
+			img.meta[rest[1]] = rest[2]
+			return "", nil
+		case "remove":
+			if img.exclusiveHeld() {
+				return "", fakeExitError(int(syscall.EROFS))
+			}
+			if _, ok := img.meta[rest[1]]; !ok {
+				return "", fakeExitError(2)
+			}
+			delete(img.meta, rest[1])
+			return "", nil
+		}
+
+	case "map":
+		key, img := imageArg(0)
+		if img == nil {
+			return "", fakeExitError(2)
+		}
+		if opts["--options"] == "exclusive" {
+			if !contains(img.features, "exclusive-lock") {
+				return "", fakeExitError(22)
+			}
+			if len(img.locks) > 0 {
+				return "", fakeExitError(30)
+			}
+			img.locks = append(img.locks, rbdLock{Locker: "client.5123", ID: exclusiveLockCookiePrefix + "18446462598732840961", Address: "10.0.0.5:0/5123"})
+		}
+		// like the kernel, use the lowest free device id
+		dev := ""
+		for i := 0; dev == ""; i++ {
+			if _, used := f.mapped[fmt.Sprintf("/dev/rbd%d", i)]; !used {
+				dev = fmt.Sprintf("/dev/rbd%d", i)
+			}
+		}
+		f.mapped[dev] = key
+		return dev, nil
+
+	case "unmap":
+		dev := rest[0]
+		if _, ok := f.mapped[dev]; !ok {
+			return "", fakeExitError(22)
+		}
+		for _, mdev := range f.mounts {
+			if mdev == dev {
+				return "", fakeExitError(16)
+			}
+		}
+		img := f.images[f.mapped[dev]]
+		if img == nil {
+			// image removed while mapped
+			img = &fakeImage{}
+		}
+		if img.inUse {
+			return "", fakeExitError(16)
+		}
+		// the kernel client lets go of the exclusive lock
+		for i, l := range img.locks {
+			if strings.HasPrefix(l.ID, exclusiveLockCookiePrefix) && l.Address == "10.0.0.5:0/5123" {
+				img.locks = append(img.locks[:i], img.locks[i+1:]...)
+				break
+			}
+		}
+		delete(f.mapped, dev)
+		return "", nil
+
+	case "showmapped":
+		mappings := []rbdMapping{}
+		for dev, key := range f.mapped {
+			parts := strings.SplitN(key, "/", 2)
+			mappings = append(mappings, rbdMapping{ID: strings.TrimPrefix(dev, "/dev/rbd"), Pool: parts[0], Image: parts[1], Snap: "-", Device: dev})
+		}
+		sort.Slice(mappings, func(i, j int) bool { return mappings[i].Device < mappings[j].Device })
+		return fakeJSON(mappings), nil
+	}
+
+	return "", fakeExitError(22)
+}
+
+func TestFakeRBD_lockAndMap(t *testing.T) {
+	fake := newFakeRBD()
+	fake.addImage("rbd", "foo", "xfs")
+
+	_, err := fake.Run(context.Background(), "rbd", "--pool", "rbd", "lock", "add", "foo", "host1")
+	assert.Nil(t, err, formatError("lock add", err))
+	_, err = fake.Run(context.Background(), "rbd", "--pool", "rbd", "lock", "add", "foo", "host2")
+	assert.True(t, isExitCode(err, syscall.EBUSY), "Expected busy error for second lock")
+
+	dev, err := fake.Run(context.Background(), "rbd", "--pool", "rbd", "map", "foo")
+	assert.Nil(t, err, formatError("map", err))
+	assert.Equal(t, "/dev/rbd0", dev)
+
+	out, err := fake.Run(context.Background(), "rbd", "showmapped", "--format", "json")
+	assert.Nil(t, err, formatError("showmapped", err))
+	mappings, err := parseRBDShowMapped(out)
+	assert.Nil(t, err, formatError("parseRBDShowMapped", err))
+	assert.Equal(t, []rbdMapping{{ID: "0", Pool: "rbd", Image: "foo", Snap: "-", Device: "/dev/rbd0"}}, mappings)
+}
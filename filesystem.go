@@ -0,0 +1,240 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Filesystem handlers, registered per fstype: how to make, check, repair and
+// grow a filesystem, and how to mount it. Create and Mount look up the
+// handler for the fstype of the volume (see filesystemFor), types without
+// one get only mkfs.<fstype> and a plain mount.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// how long mkfs may take on a new image
+	mkfsTimeout = 5 * time.Minute
+	// how long a repair may take, killing it halfway is worse than waiting
+	fsRepairTimeout = 30 * time.Minute
+)
+
+// Filesystem handles one type of filesystem on a mapped device
+type Filesystem interface {
+	// Make creates the filesystem on a new device, with extra mkfs arguments
+	Make(sh fsShell, device string, args []string) error
+	// Check looks for errors without modifying the (unmounted) device, the
+	// error is nil if the filesystem is clean. Returns the tool output.
+	Check(sh fsShell, device string) (string, error)
+	// Repair fixes errors on the unmounted device, returns the tool output
+	Repair(sh fsShell, device string) (string, error)
+	// Grow grows the mounted filesystem to the size of its device
+	Grow(sh fsShell, device, mountdir string) error
+	// Size returns the size in bytes of the mounted filesystem
+	Size(sh fsShell, device, mountdir string) (uint64, error)
+	// MountOptions returns the options needed to mount it, on a read-only
+	// device the log of a filesystem last used by a writer can't be replayed
+	MountOptions(readOnly bool) []string
+}
+
+// fsShell runs the filesystem tools, it's the driver's sh and shWithTimeout
+type fsShell interface {
+	sh(name string, args ...string) (string, error)
+	shWithTimeout(howLong time.Duration, name string, args ...string) (string, error)
+}
+
+var (
+	filesystemsMutex sync.RWMutex
+	filesystems      = map[string]Filesystem{}
+)
+
+func init() {
+	registerFilesystem("xfs", xfsFilesystem{})
+	for _, fstype := range []string{"ext2", "ext3", "ext4"} {
+		registerFilesystem(fstype, extFilesystem{fstype: fstype})
+	}
+	registerFilesystem("btrfs", btrfsFilesystem{})
+}
+
+// registerFilesystem sets the handler for fstype, replacing any earlier one
+func registerFilesystem(fstype string, fs Filesystem) {
+	filesystemsMutex.Lock()
+	defer filesystemsMutex.Unlock()
+	filesystems[fstype] = fs
+}
+
+// filesystemFor returns the handler registered for fstype, or a basic one
+// that can only make and mount it
+func filesystemFor(fstype string) Filesystem {
+	filesystemsMutex.RLock()
+	defer filesystemsMutex.RUnlock()
+	fs, ok := filesystems[fstype]
+	if !ok {
+		return otherFilesystem{fstype: fstype}
+	}
+	return fs
+}
+
+// runMkfs makes a filesystem, the device goes last - give it some time
+func runMkfs(sh fsShell, mkfs, device string, args []string) error {
+	args = append(append([]string{}, args...), device)
+	_, err := sh.shWithTimeout(mkfsTimeout, mkfs, args...)
+	return err
+}
+
+// xfsFilesystem uses xfsprogs
+type xfsFilesystem struct{}
+
+func (xfsFilesystem) Make(sh fsShell, device string, args []string) error {
+	return runMkfs(sh, "mkfs.xfs", device, args)
+}
+
+func (xfsFilesystem) Check(sh fsShell, device string) (string, error) {
+	// "xfs_repair  -n  (no  modify node) will return a status of 1 if filesystem
+	// corruption was detected and 0 if no filesystem corruption was detected." xfs_repair(8)
+	return sh.sh("xfs_repair", "-n", device)
+}
+
+func (xfsFilesystem) Repair(sh fsShell, device string) (string, error) {
+	// without -L: a dirty log has to be replayed by mounting, not zeroed
+	return sh.shWithTimeout(fsRepairTimeout, "xfs_repair", device)
+}
+
+func (xfsFilesystem) Grow(sh fsShell, device, mountdir string) error {
+	_, err := sh.sh("xfs_growfs", mountdir)
+	return err
+}
+
+func (xfsFilesystem) Size(sh fsShell, device, mountdir string) (uint64, error) {
+	out, err := sh.sh("xfs_info", mountdir)
+	if err != nil {
+		return 0, err
+	}
+	return parseXFSInfoSize(out)
+}
+
+func (xfsFilesystem) MountOptions(readOnly bool) []string {
+	if readOnly {
+		return []string{"ro", "norecovery"}
+	}
+	return nil
+}
+
+// extFilesystem uses e2fsprogs for ext2, ext3 and ext4
+type extFilesystem struct {
+	fstype string
+}
+
+func (e extFilesystem) Make(sh fsShell, device string, args []string) error {
+	return runMkfs(sh, "mkfs."+e.fstype, device, args)
+}
+
+func (extFilesystem) Check(sh fsShell, device string) (string, error) {
+	// e2fsck -n answers no to all questions, exits 4 on errors left uncorrected
+	return sh.sh("e2fsck", "-n", device)
+}
+
+func (extFilesystem) Repair(sh fsShell, device string) (string, error) {
+	// preen: fix what is safe without asking, exit 1 means errors were corrected
+	out, err := sh.shWithTimeout(fsRepairTimeout, "e2fsck", "-p", device)
+	if exitCode(err) == 1 {
+		return out, nil
+	}
+	return out, err
+}
+
+func (extFilesystem) Grow(sh fsShell, device, mountdir string) error {
+	// online resize of a mounted filesystem
+	_, err := sh.sh("resize2fs", device)
+	return err
+}
+
+func (extFilesystem) Size(sh fsShell, device, mountdir string) (uint64, error) {
+	out, err := sh.sh("dumpe2fs", "-h", device)
+	if err != nil {
+		return 0, err
+	}
+	return parseDumpe2fsSize(out)
+}
+
+func (e extFilesystem) MountOptions(readOnly bool) []string {
+	if !readOnly {
+		return nil
+	}
+	if e.fstype == "ext2" {
+		// no journal to skip
+		return []string{"ro"}
+	}
+	return []string{"ro", "noload"}
+}
+
+// btrfsFilesystem uses btrfs-progs
+type btrfsFilesystem struct{}
+
+func (btrfsFilesystem) Make(sh fsShell, device string, args []string) error {
+	return runMkfs(sh, "mkfs.btrfs", device, args)
+}
+
+func (btrfsFilesystem) Check(sh fsShell, device string) (string, error) {
+	return sh.sh("btrfs", "check", "--readonly", device)
+}
+
+func (btrfsFilesystem) Repair(sh fsShell, device string) (string, error) {
+	// btrfs check --repair can make things worse, see btrfs-check(8)
+	return "", fmt.Errorf("btrfs filesystems are not repaired automatically, see btrfs check --repair")
+}
+
+func (btrfsFilesystem) Grow(sh fsShell, device, mountdir string) error {
+	_, err := sh.sh("btrfs", "filesystem", "resize", "max", mountdir)
+	return err
+}
+
+func (btrfsFilesystem) Size(sh fsShell, device, mountdir string) (uint64, error) {
+	out, err := sh.sh("btrfs", "filesystem", "show", "--raw", mountdir)
+	if err != nil {
+		return 0, err
+	}
+	return parseBtrfsShowSize(out)
+}
+
+func (btrfsFilesystem) MountOptions(readOnly bool) []string {
+	if readOnly {
+		return []string{"ro", "nologreplay"}
+	}
+	return nil
+}
+
+// otherFilesystem is any fstype without a handler: made with mkfs.<fstype>,
+// mounted as is and never checked
+type otherFilesystem struct {
+	fstype string
+}
+
+func (o otherFilesystem) Make(sh fsShell, device string, args []string) error {
+	return runMkfs(sh, "mkfs."+o.fstype, device, args)
+}
+
+func (otherFilesystem) Check(sh fsShell, device string) (string, error) {
+	return "", nil
+}
+
+func (o otherFilesystem) Repair(sh fsShell, device string) (string, error) {
+	return "", fmt.Errorf("Unable to repair %s filesystem, no handler for it", o.fstype)
+}
+
+func (o otherFilesystem) Grow(sh fsShell, device, mountdir string) error {
+	return fmt.Errorf("Unable to grow %s filesystem, only xfs, ext2/3/4 and btrfs", o.fstype)
+}
+
+func (o otherFilesystem) Size(sh fsShell, device, mountdir string) (uint64, error) {
+	return 0, fmt.Errorf("unable to get size of %s filesystem", o.fstype)
+}
+
+func (otherFilesystem) MountOptions(readOnly bool) []string {
+	if readOnly {
+		return []string{"ro"}
+	}
+	return nil
+}
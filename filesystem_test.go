@@ -0,0 +1,96 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilesystemFor(t *testing.T) {
+	assert.IsType(t, xfsFilesystem{}, filesystemFor("xfs"))
+	assert.Equal(t, extFilesystem{fstype: "ext3"}, filesystemFor("ext3"))
+	assert.IsType(t, btrfsFilesystem{}, filesystemFor("btrfs"))
+	assert.Equal(t, otherFilesystem{fstype: "vfat"}, filesystemFor("vfat"))
+
+	assert.Equal(t, []string{"ro", "noload"}, filesystemFor("ext4").MountOptions(true))
+	assert.Equal(t, []string{"ro"}, filesystemFor("ext2").MountOptions(true))
+	assert.Nil(t, filesystemFor("xfs").MountOptions(false))
+}
+
+func TestCreate_makesFilesystem(t *testing.T) {
+	*canCreateVolumes = true
+	defer func() { *canCreateVolumes = false }()
+
+	for _, fstype := range []string{"xfs", "ext4", "btrfs"} {
+		d, fake, cleanup := newFakeDriver(t)
+		err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"fstype": fstype}})
+		assert.Nil(t, err, formatError("Create", err))
+		assert.Equal(t, fstype, fake.images["rbd/foo"].fstype)
+		assert.Equal(t, 1, fake.countCalls("mkfs."+fstype), "Expected mkfs.%s", fstype)
+		cleanup()
+	}
+}
+
+func TestMount_checksFilesystem(t *testing.T) {
+	checks := map[string]string{
+		"xfs":   "xfs_repair -n /dev/rbd",
+		"ext4":  "e2fsck -n /dev/rbd",
+		"btrfs": "btrfs check --readonly /dev/rbd",
+	}
+	for fstype, check := range checks {
+		d, fake, cleanup := newFakeDriver(t)
+		fake.addImage("rbd", "clean", fstype)
+		img := fake.addImage("rbd", "dirty", fstype)
+		img.dirty = true
+
+		_, err := d.Mount(&volume.MountRequest{Name: "clean", ID: "c1"})
+		assert.Nil(t, err, formatError("Mount", err))
+		assert.Equal(t, 1, fake.countCalls(check), "Expected %s filesystem to be checked", fstype)
+
+		// check, replay the log by mount/unmount, check again
+		_, err = d.Mount(&volume.MountRequest{Name: "dirty", ID: "c1"})
+		assertErrorKind(t, KindFilesystemCorrupt, err)
+		assert.Equal(t, 3, fake.countCalls(check), "Expected dirty %s filesystem to be checked twice", fstype)
+		cleanup()
+	}
+}
+
+func TestMount_uncheckedFilesystem(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	img := fake.addImage("rbd", "foo", "vfat")
+	img.dirty = true
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, 1, len(fake.mounts), "Expected image to be mounted")
+}
+
+func TestFilesystemRepair(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	for _, fstype := range []string{"xfs", "ext4", "btrfs"} {
+		img := fake.addImage("rbd", fstype, fstype)
+		img.dirty = true
+		device, err := d.mapImage("rbd", fstype)
+		assert.Nil(t, err, formatError("mapImage", err))
+
+		fs := filesystemFor(fstype)
+		_, err = fs.Check(&d, device)
+		assert.NotNil(t, err, "Expected %s check to find errors", fstype)
+		_, err = fs.Repair(&d, device)
+		if fstype == "btrfs" {
+			assert.NotNil(t, err, "Expected no automatic btrfs repair")
+			assert.True(t, img.dirty)
+			continue
+		}
+		assert.Nil(t, err, formatError(fstype+" Repair", err))
+		_, err = fs.Check(&d, device)
+		assert.Nil(t, err, "Expected %s filesystem to be clean after repair", fstype)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Filesystem checks on Mount, and what to do about errors: the --fs-policy,
+// or the fs-policy of the volume (kept as image-meta). Every step taken on a
+// filesystem with errors is recorded in the repair log of the volume,
+// <logdir>/<name>-repair/<pool>/<image>.log, with the output of the tools.
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// filesystem check policies, see the fs-policy create option
+const (
+	fsPolicyNone       = "none"        // mount without checking
+	fsPolicyCheck      = "check"       // refuse to mount a filesystem with errors
+	fsPolicyReplay     = "replay"      // replay the log by mount/unmount, refuse if errors remain
+	fsPolicyAutoRepair = "auto-repair" // replay, then run the repair tool, refuse if errors remain
+)
+
+// fsRepairEntry is one line of the repair log of a volume
+type fsRepairEntry struct {
+	Time   time.Time `json:"time"`
+	Pool   string    `json:"pool"`
+	Image  string    `json:"image"`
+	Device string    `json:"device"`
+	FSType string    `json:"fstype"`
+	Policy fsPolicy  `json:"policy"`
+	Action string    `json:"action"` // check, replay or repair
+	Output string    `json:"output,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// verifyDeviceFilesystem checks the filesystem for errors with its handler
+// (see Filesystem.Check), and tries to fix them as far as policy allows
+func (d *cephRBDVolumeDriver) verifyDeviceFilesystem(pool, name, device, mount, fstype string, policy fsPolicy) error {
+	if policy == fsPolicyNone {
+		return nil
+	}
+	fs := filesystemFor(fstype)
+
+	// add a step to the repair log, returns its error
+	record := func(action, out string, err error) error {
+		entry := fsRepairEntry{
+			Time:   time.Now().UTC(),
+			Pool:   pool,
+			Image:  name,
+			Device: device,
+			FSType: fstype,
+			Policy: policy,
+			Action: action,
+			Output: out,
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		d.logRepair(entry)
+		return err
+	}
+
+	out, err := fs.Check(d, device)
+	if err == nil {
+		return nil
+	}
+	record("check", out, err)
+	// propagate timeout errors - can't recover? system error? don't try to mount at that point
+	if _, ok := err.(ShTimeoutError); ok || policy == fsPolicyCheck {
+		return err
+	}
+
+	// assume any other error is a filesystem error and attempt limited repair
+	log.Printf("WARN: attempting limited %s repair (mount/unmount) of %s  %s", fstype, device, mount)
+	err = record("replay", "", d.replayFilesystemLog(fstype, device, mount))
+	if err == nil {
+		out, err = fs.Check(d, device)
+		if record("check", out, err) == nil {
+			return nil
+		}
+		if _, ok := err.(ShTimeoutError); ok {
+			return err
+		}
+	}
+	// a filesystem too broken to mount may still be repaired
+	if policy != fsPolicyAutoRepair {
+		return err
+	}
+
+	log.Printf("WARN: repairing %s filesystem of %s/%s on %s", fstype, pool, name, device)
+	out, err = fs.Repair(d, device)
+	if record("repair", out, err) != nil {
+		return err
+	}
+	out, err = fs.Check(d, device)
+	return record("check", out, err)
+}
+
+// replayFilesystemLog will try mount/unmount, replaying the journal or log
+// of a filesystem last used by a crashed host
+func (d *cephRBDVolumeDriver) replayFilesystemLog(fstype, device, mount string) error {
+	err := d.mountDevice(fstype, device, mount)
+	if err != nil {
+		return err
+	}
+	return d.unmountDevice(device)
+}
+
+// repairLogPath is where the repair log of a volume goes
+func (d *cephRBDVolumeDriver) repairLogPath(pool, name string) string {
+	return filepath.Join(d.repairLogDir, pool, name+".log")
+}
+
+// logRepair appends a step to the repair log of the volume
+func (d *cephRBDVolumeDriver) logRepair(entry fsRepairEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("ERROR: unable to encode repair log entry: %s", err)
+		return
+	}
+	log.Printf("INFO: filesystem repair: %s", data)
+	if d.repairLogDir == "" {
+		return
+	}
+	path := d.repairLogPath(entry.Pool, entry.Image)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		log.Printf("ERROR: unable to create repair log directory: %s", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("ERROR: unable to open repair log %s: %s", path, err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		log.Printf("ERROR: unable to write repair log %s: %s", path, err)
+	}
+}
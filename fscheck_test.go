@@ -0,0 +1,118 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+)
+
+// readRepairLog returns the actions in the repair log of a volume
+func readRepairLog(t *testing.T, d cephRBDVolumeDriver, pool, name string) []fsRepairEntry {
+	data, err := ioutil.ReadFile(d.repairLogPath(pool, name))
+	if err != nil {
+		return nil
+	}
+	entries := []fsRepairEntry{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		entry := fsRepairEntry{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func repairActions(entries []fsRepairEntry) []string {
+	actions := []string{}
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	return actions
+}
+
+func TestMount_fsPolicy(t *testing.T) {
+	defer func(policy fsPolicy) { fsPolicyFlag = policy }(fsPolicyFlag)
+
+	tests := []struct {
+		policy  fsPolicy
+		mounted bool
+		actions []string
+	}{
+		{fsPolicyNone, true, []string{}},
+		{fsPolicyCheck, false, []string{"check"}},
+		{fsPolicyReplay, false, []string{"check", "replay", "check"}},
+		{fsPolicyAutoRepair, true, []string{"check", "replay", "check", "repair", "check"}},
+	}
+	for _, test := range tests {
+		d, fake, cleanup := newFakeDriver(t)
+		d.repairLogDir = filepath.Join(filepath.Dir(d.stateFile), "repair")
+		fsPolicyFlag = test.policy
+
+		// errors a log replay doesn't fix
+		img := fake.addImage("rbd", "foo", "xfs")
+		img.dirty = true
+
+		_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+		if test.mounted {
+			assert.Nil(t, err, formatError("Mount "+string(test.policy), err))
+		} else {
+			assertErrorKind(t, KindFilesystemCorrupt, err)
+		}
+		assert.Equal(t, test.mounted, len(fake.mounts) == 1, "Expected mounted=%v with policy %s", test.mounted, test.policy)
+		assert.Equal(t, test.actions, repairActions(readRepairLog(t, d, "rbd", "foo")), "Expected repair log for policy %s", test.policy)
+		cleanup()
+	}
+}
+
+func TestMount_repairLog(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	d.repairLogDir = filepath.Join(filepath.Dir(d.stateFile), "repair")
+
+	img := fake.addImage("rbd", "foo", "ext4")
+	img.dirty = true
+	assert.Nil(t, d.setImageMeta("rbd", "foo", metaFSPolicy, fsPolicyAutoRepair))
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.False(t, img.dirty, "Expected filesystem to be repaired")
+
+	entries := readRepairLog(t, d, "rbd", "foo")
+	if assert.Equal(t, 5, len(entries)) {
+		assert.Equal(t, "check", entries[0].Action)
+		assert.Contains(t, entries[0].Error, "e2fsck -n /dev/rbd0")
+		assert.Equal(t, "repair", entries[3].Action)
+		assert.Equal(t, fsPolicy(fsPolicyAutoRepair), entries[3].Policy)
+		assert.Equal(t, "ext4", entries[3].FSType)
+		assert.Equal(t, "", entries[4].Error, "Expected clean check after repair")
+	}
+
+	// clean filesystems leave no trace
+	fake.addImage("rbd", "bar", "ext4")
+	_, err = d.Mount(&volume.MountRequest{Name: "bar", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Nil(t, readRepairLog(t, d, "rbd", "bar"))
+}
+
+func TestCreate_fsPolicy(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	fake.addImage("rbd", "foo", "xfs")
+
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"fs-policy": "fix-it"}})
+	assertErrorKind(t, KindInvalidOption, err)
+	assert.Equal(t, 0, len(fake.image("rbd", "foo").meta), "Expected no image-meta to be set")
+
+	err = d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"fs-policy": "none"}})
+	assert.Nil(t, err, formatError("Create", err))
+	meta, err := d.imageMeta("rbd", "foo")
+	assert.Nil(t, err)
+	assert.Equal(t, fsPolicy(fsPolicyNone), volumeFSPolicy("rbd", "foo", meta))
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Growing filesystems online to the size of their device, e.g. after the
+// image was grown with `docker volume create -o size=N` or `rbd resize` by
+// hand. With --grow-on-mount (default) Mount compares the sizes every time.
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+var (
+	// device must be this much bigger than the filesystem to grow it, so
+	// rounding to filesystem blocks (or a too small xfs AG) doesn't make
+	// every Mount try again
+	minFilesystemGrowth uint64 = 16 << 20
+)
+
+// growFilesystemOnMount grows the filesystem of a just mounted volume if its
+// device is bigger, or a grow is pending from growImage. Errors are only
+// logged, the volume is usable anyway and the next Mount tries again.
+func (d *cephRBDVolumeDriver) growFilesystemOnMount(pool, name, fstype, device, mount string, meta map[string]string) {
+	_, pending := meta[metaGrowFilesystem]
+	if !pending && !*growOnMount {
+		return
+	}
+
+	grow := pending
+	devSize, fsSize, err := d.filesystemSizes(fstype, device, mount)
+	if err != nil {
+		log.Printf("WARN: unable to compare sizes of %s/%s device and filesystem: %s", pool, name, err)
+	} else if devSize >= fsSize+minFilesystemGrowth {
+		log.Printf("INFO: growing %s filesystem of %s/%s from %dMB to device size %dMB", fstype, pool, name, fsSize>>20, devSize>>20)
+		grow = true
+	} else {
+		grow = false
+	}
+
+	if grow {
+		err = d.growFilesystem(fstype, device, mount)
+		if err != nil {
+			log.Printf("WARN: unable to grow filesystem of %s/%s: %s", pool, name, err)
+			return
+		}
+	}
+	if pending {
+		err = d.removeImageMeta(pool, name, metaGrowFilesystem)
+		if err != nil {
+			log.Printf("WARN: %s", err)
+		}
+	}
+}
+
+// growFilesystem grows the mounted filesystem to the size of its device
+func (d *cephRBDVolumeDriver) growFilesystem(fstype, device, mountdir string) error {
+	err := filesystemFor(fstype).Grow(d, device, mountdir)
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: grew %s filesystem on %s (%s)", fstype, device, mountdir)
+	return nil
+}
+
+// filesystemSizes returns the sizes in bytes of the device and of the
+// mounted filesystem on it
+func (d *cephRBDVolumeDriver) filesystemSizes(fstype, device, mountdir string) (uint64, uint64, error) {
+	out, err := d.sh("blockdev", "--getsize64", device)
+	if err != nil {
+		return 0, 0, err
+	}
+	devSize, err := strconv.ParseUint(out, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to parse device size %q: %s", out, err)
+	}
+	fsSize, err := filesystemFor(fstype).Size(d, device, mountdir)
+	if err != nil {
+		return 0, 0, err
+	}
+	return devSize, fsSize, nil
+}
+
+// parseXFSInfoSize gets the data section size from xfs_info:
+//
+//	data     =                       bsize=4096   blocks=262144, imaxpct=25
+func parseXFSInfoSize(out string) (uint64, error) {
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data") {
+			continue
+		}
+		var bsize, blocks uint64
+		for _, field := range strings.Fields(strings.Replace(line, ",", " ", -1)) {
+			if strings.HasPrefix(field, "bsize=") {
+				bsize, _ = strconv.ParseUint(strings.TrimPrefix(field, "bsize="), 10, 64)
+			} else if strings.HasPrefix(field, "blocks=") {
+				blocks, _ = strconv.ParseUint(strings.TrimPrefix(field, "blocks="), 10, 64)
+			}
+		}
+		if bsize > 0 && blocks > 0 {
+			return bsize * blocks, nil
+		}
+	}
+	return 0, fmt.Errorf("no data section size in xfs_info output")
+}
+
+// parseDumpe2fsSize gets the filesystem size from the dumpe2fs -h superblock:
+//
+//	Block count:              262144
+//	Block size:               4096
+func parseDumpe2fsSize(out string) (uint64, error) {
+	var count, size uint64
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch parts[0] {
+		case "Block count":
+			count, _ = strconv.ParseUint(value, 10, 64)
+		case "Block size":
+			size, _ = strconv.ParseUint(value, 10, 64)
+		}
+	}
+	if count == 0 || size == 0 {
+		return 0, fmt.Errorf("no block count and size in dumpe2fs output")
+	}
+	return count * size, nil
+}
+
+// parseBtrfsShowSize gets the size of the (single) device of the filesystem
+// from btrfs filesystem show --raw:
+//
+//	devid    1 size 1073741824 used 228589568 path /dev/rbd0
+func parseBtrfsShowSize(out string) (uint64, error) {
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != "devid" || fields[2] != "size" {
+			continue
+		}
+		return strconv.ParseUint(fields[3], 10, 64)
+	}
+	return 0, fmt.Errorf("no device size in btrfs filesystem show output")
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseXFSInfoSize(t *testing.T) {
+	out := `meta-data=/dev/rbd0              isize=512    agcount=8, agsize=32768 blks
+         =                       sectsz=512   attr=2, projid32bit=1
+data     =                       bsize=4096   blocks=262144, imaxpct=25
+         =                       sunit=1024   swidth=1024 blks
+naming   =version 2              bsize=4096   ascii-ci=0 ftype=1
+log      =internal log           bsize=4096   blocks=2560, version=2`
+	size, err := parseXFSInfoSize(out)
+	assert.Nil(t, err, formatError("parseXFSInfoSize", err))
+	assert.Equal(t, uint64(1<<30), size)
+
+	_, err = parseXFSInfoSize("")
+	assert.NotNil(t, err, "Expected error for missing data section")
+}
+
+func TestParseDumpe2fsSize(t *testing.T) {
+	out := `dumpe2fs 1.45.5 (07-Jan-2020)
+Filesystem volume name:   <none>
+Block count:              262144
+Reserved block count:     13107
+Block size:               4096`
+	size, err := parseDumpe2fsSize(out)
+	assert.Nil(t, err, formatError("parseDumpe2fsSize", err))
+	assert.Equal(t, uint64(1<<30), size)
+}
+
+func TestParseBtrfsShowSize(t *testing.T) {
+	out := "Label: none  uuid: 5a3e\n\tTotal devices 1 FS bytes used 114688\n\tdevid    1 size 1073741824 used 228589568 path /dev/rbd0\n"
+	size, err := parseBtrfsShowSize(out)
+	assert.Nil(t, err, formatError("parseBtrfsShowSize", err))
+	assert.Equal(t, uint64(1<<30), size)
+}
+
+func TestMount_growsFilesystem(t *testing.T) {
+	for _, fstype := range []string{"xfs", "ext4", "btrfs"} {
+		d, fake, cleanup := newFakeDriver(t)
+		img := fake.addImage("rbd", "foo", fstype)
+		// rbd resize by hand
+		img.size = 2048
+
+		_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+		assert.Nil(t, err, formatError("Mount", err))
+		assert.Equal(t, 2048, img.fsSize, "Expected %s filesystem to be grown", fstype)
+		cleanup()
+	}
+}
+
+func TestMount_growOnMountDisabled(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer func(grow bool) { *growOnMount = grow }(*growOnMount)
+	*growOnMount = false
+
+	img := fake.addImage("rbd", "foo", "xfs")
+	img.size = 2048
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, 1024, img.fsSize, "Expected filesystem not to be grown")
+	assert.Equal(t, 0, fake.countCalls("blockdev"), "Expected no size check")
+}
+
+func TestMount_sameSize(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	fake.addImage("rbd", "foo", "xfs")
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, 0, fake.countCalls("xfs_growfs"), "Expected no grow")
+}
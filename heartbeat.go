@@ -0,0 +1,154 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Lock leases: advisory locks never expire, so while we hold an image we keep
+// writing a heartbeat into its image-meta. Anyone looking at the lock can then
+// tell a live holder (lease not expired) from a dead one.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// lockHeartbeat is the heartbeat image-meta value
+type lockHeartbeat struct {
+	Host         string    `json:"host"`             // describes the holder, see lockCookie
+	Lock         string    `json:"lock"`             // cookie of the lock held
+	Client       string    `json:"client,omitempty"` // kernel client address, fenced when breaking the lock
+	Time         time.Time `json:"time"`
+	MountIDs     []string  `json:"mount_ids"`
+	LeaseExpires time.Time `json:"lease_expires"`
+}
+
+// expired tells if the holder missed renewing its lease
+func (hb lockHeartbeat) expired(now time.Time) bool {
+	return now.After(hb.LeaseExpires)
+}
+
+// startHeartbeat renews the lease of every volume we hold each
+// --heartbeat-interval, until stop is called (which waits for a running
+// heartbeat to finish)
+func (d *cephRBDVolumeDriver) startHeartbeat() (stop func()) {
+	if *heartbeatInterval <= 0 {
+		log.Printf("INFO: lock heartbeat disabled")
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	log.Printf("INFO: writing lock heartbeat every %s, lease %s", *heartbeatInterval, *leaseTTL)
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(*heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.heartbeat()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// heartbeat renews the lease of every volume we hold
+func (d *cephRBDVolumeDriver) heartbeat() {
+	d.m.RLock()
+	mounts := []string{}
+	for mount := range d.volumes {
+		mounts = append(mounts, mount)
+	}
+	d.m.RUnlock()
+
+	for _, mount := range mounts {
+		vol, found := d.getVolume(mount)
+		if !found {
+			continue
+		}
+		// don't race a concurrent Unmount removing the heartbeat
+		unlock := d.locks.lock(vol.Pool, vol.Name)
+		if vol, found = d.getVolume(mount); found {
+			d.writeHeartbeat(vol)
+		}
+		unlock()
+	}
+}
+
+// writeHeartbeat renews the lease on a volume we hold, caller must hold the
+// volume lock. Errors are only logged, the next heartbeat will try again.
+// Read-only volumes have no lock, so no lease either. Neither have exclusive
+// lock mode volumes: the kernel client holding the exclusive lock refuses
+// image-meta writes from anybody else, and the plugin never breaks that lock.
+func (d *cephRBDVolumeDriver) writeHeartbeat(vol *Volume) {
+	if *heartbeatInterval <= 0 || vol.ReadOnly || vol.LockMode == lockModeExclusive {
+		return
+	}
+	now := time.Now()
+	hb := lockHeartbeat{
+		Host:         d.cookie.describe(),
+		Lock:         vol.Locker,
+		Client:       vol.Client,
+		Time:         now,
+		MountIDs:     vol.MountIDs,
+		LeaseExpires: now.Add(*leaseTTL),
+	}
+	data, err := json.Marshal(hb)
+	if err != nil {
+		log.Printf("ERROR: unable to encode heartbeat of %s/%s: %s", vol.Pool, vol.Name, err)
+		return
+	}
+	err = d.setImageMeta(vol.Pool, vol.Name, metaHeartbeat, string(data))
+	if err != nil {
+		log.Printf("WARN: unable to write heartbeat: %s", err)
+	}
+}
+
+// clearHeartbeat drops the heartbeat when we let go of a volume
+func (d *cephRBDVolumeDriver) clearHeartbeat(pool, name string) {
+	if *heartbeatInterval <= 0 {
+		return
+	}
+	err := d.removeImageMeta(pool, name, metaHeartbeat)
+	if err != nil {
+		log.Printf("WARN: unable to remove heartbeat: %s", err)
+	}
+}
+
+// imageHeartbeat returns the last heartbeat written for the image lock with
+// the given cookie, nil if there is none (e.g. holder is an older plugin
+// version, or the heartbeat is left from an earlier lock)
+func (d *cephRBDVolumeDriver) imageHeartbeat(pool, name, cookie string) (*lockHeartbeat, error) {
+	meta, err := d.imageMeta(pool, name)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := meta[metaHeartbeat]
+	if !ok {
+		return nil, nil
+	}
+	hb := &lockHeartbeat{}
+	err = json.Unmarshal([]byte(value), hb)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse heartbeat of %s/%s: %s", pool, name, err)
+	}
+	if hb.Lock != cookie {
+		return nil, nil
+	}
+	return hb, nil
+}
+
+// describe explains the lease state for lock error messages
+func (hb lockHeartbeat) describe(now time.Time) string {
+	if hb.expired(now) {
+		return fmt.Sprintf("lease expired %s ago (last heartbeat %s)", now.Sub(hb.LeaseExpires).Round(time.Second), hb.Time.UTC().Format(time.RFC3339))
+	}
+	return fmt.Sprintf("lease valid until %s", hb.LeaseExpires.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHeartbeat reads our heartbeat from the fake image-meta
+func fakeHeartbeat(t *testing.T, fake *fakeRBD, pool, name string) *lockHeartbeat {
+	value, ok := fake.imageMetaValue(pool, name, imageMetaPrefix+metaHeartbeat)
+	if !ok {
+		return nil
+	}
+	hb := &lockHeartbeat{}
+	assert.Nil(t, json.Unmarshal([]byte(value), hb))
+	return hb
+}
+
+func TestHeartbeat_mountUnmount(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	fake.addImage("rbd", "foo", "xfs")
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	vol, _ := d.getVolume(d.mountpoint("rbd", "foo"))
+	hb := fakeHeartbeat(t, fake, "rbd", "foo")
+	if assert.NotNil(t, hb, "Expected heartbeat after Mount") {
+		assert.Equal(t, vol.Locker, hb.Lock)
+		assert.Equal(t, d.cookie.describe(), hb.Host)
+		assert.Equal(t, fake.address, hb.Client, "Expected our kernel client in the heartbeat")
+		assert.Equal(t, []string{"c1"}, hb.MountIDs)
+		assert.Equal(t, *leaseTTL, hb.LeaseExpires.Sub(hb.Time))
+	}
+
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c2"})
+	assert.Nil(t, err, formatError("Mount", err))
+	first := fakeHeartbeat(t, fake, "rbd", "foo")
+	assert.Equal(t, []string{"c1", "c2"}, first.MountIDs)
+
+	// renewed by the background heartbeat
+	time.Sleep(10 * time.Millisecond)
+	d.heartbeat()
+	renewed := fakeHeartbeat(t, fake, "rbd", "foo")
+	assert.True(t, renewed.LeaseExpires.After(first.LeaseExpires), "Expected lease to be renewed")
+
+	err = d.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Equal(t, []string{"c2"}, fakeHeartbeat(t, fake, "rbd", "foo").MountIDs)
+	err = d.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c2"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Nil(t, fakeHeartbeat(t, fake, "rbd", "foo"), "Expected heartbeat to be removed on last Unmount")
+}
+
+func TestHeartbeat_exclusive(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer func(mode lockMode) { lockModeFlag = mode }(lockModeFlag)
+	lockModeFlag = lockModeExclusive
+	img := fake.addImage("rbd", "foo", "xfs")
+	img.features = []string{"layering", "exclusive-lock"}
+
+	// the kernel client holding the exclusive lock refuses image-meta writes
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	d.heartbeat()
+	assert.Nil(t, fakeHeartbeat(t, fake, "rbd", "foo"), "Expected no heartbeat in exclusive lock mode")
+	assert.Equal(t, 0, fake.countCalls("rbd --pool rbd --conf  --id admin image-meta set"), "Expected no image-meta writes")
+	assert.False(t, d.breaker.isOpen(), "Expected the cluster still taken as available")
+
+	err = d.Unmount(&volume.UnmountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Unmount", err))
+	assert.Equal(t, 0, fake.countCalls("rbd --pool rbd --conf  --id admin image-meta remove"), "Expected no image-meta writes")
+}
+
+func TestStartHeartbeat(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer func(interval time.Duration) { *heartbeatInterval = interval }(*heartbeatInterval)
+	*heartbeatInterval = 10 * time.Millisecond
+	fake.addImage("rbd", "foo", "xfs")
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	writes := fake.countCalls("rbd --pool rbd --conf  --id admin image-meta set foo " + imageMetaPrefix + metaHeartbeat)
+
+	stop := d.startHeartbeat()
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	assert.True(t, fake.countCalls("rbd --pool rbd --conf  --id admin image-meta set foo "+imageMetaPrefix+metaHeartbeat) > writes,
+		"Expected background heartbeat writes")
+}
+
+func TestMount_lockedReportsLease(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+	fake.heartbeatFromOtherHost("rbd", "foo", "otherhost", time.Now().Add(-time.Hour))
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	if assert.NotNil(t, err, "Expected Mount to fail on locked image") {
+		assert.Contains(t, err.Error(), "lease expired 1h0m0s ago")
+	}
+}
+
+func TestMount_breakStaleLock_leaseExpired(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	// no waiting for the grace period: the lease tells the holder is gone
+	defer setStaleLockFlags(time.Hour)()
+
+	img := fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+	fake.heartbeatFromOtherHost("rbd", "foo", "otherhost", time.Now().Add(-time.Minute))
+	img.watchers = nil
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, []string{"10.0.0.9:0/3524101"}, fake.blocklist, "Expected old holder's kernel client to be fenced")
+	hb := fakeHeartbeat(t, fake, "rbd", "foo")
+	if assert.NotNil(t, hb) {
+		assert.Equal(t, d.cookie.describe(), hb.Host, "Expected our heartbeat to replace the old one")
+	}
+}
+
+func TestMount_breakStaleLock_leaseValid(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer setStaleLockFlags(0)()
+
+	// no watchers (e.g. between map retries), but still renewing its lease
+	img := fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+	fake.heartbeatFromOtherHost("rbd", "foo", "otherhost", time.Now().Add(time.Minute))
+	img.watchers = nil
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected Mount to fail while the lease is valid")
+	assert.Equal(t, 0, len(fake.blocklist), "Expected nobody to be fenced")
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Per-volume settings, given as `docker volume create -o KEY=VAL` options, are
+// kept with the image as rbd image-meta, so every host mounting the volume
+// uses the same settings.
+
+import (
+	"log"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// prefix of our image-meta keys, to keep clear of librbd conf_* overrides
+const imageMetaPrefix = "rbd-docker-plugin."
+
+// image-meta keys
+const (
+	metaLockWait     = "lock-wait"
+	metaHeartbeat    = "heartbeat"     // lease of the current lock holder, see lockHeartbeat
+	metaAccess       = "access"        // accessReadWrite or accessReadOnly
+	metaFSPolicy     = "fs-policy"     // filesystem check policy, see verifyDeviceFilesystem
+	metaMountOptions = "mount-options" // comma separated, see volumeMountOptions
+	metaMkfsOptions  = "mkfs-options"  // mkfs arguments the filesystem was made with, see volumeMkfsArgs
+
+	metaGrowFilesystem = "grow-filesystem" // image grown to this size (MB), filesystem not yet
+)
+
+// volume access modes, see the access create option
+const (
+	accessReadWrite = "rw" // one host at a time, holding the image lock
+	accessReadOnly  = "ro" // shared: any number of hosts map it read-only, without a lock
+)
+
+var VALID_ACCESS_MODES = []string{accessReadWrite, accessReadOnly}
+
+// imageMeta returns our image-meta of an image, keys without prefix. Images
+// without any, or on clusters too old for image-meta, get an empty map: the
+// defaults apply.
+func (d *cephRBDVolumeDriver) imageMeta(pool, name string) (map[string]string, error) {
+	out, err := d.rbdshJSON(pool, "image-meta", "list", name)
+	if err != nil {
+		if isExitCode(err, syscall.ENOENT) {
+			return map[string]string{}, nil
+		}
+		if isImageMetaUnsupported(err) {
+			log.Printf("WARN: no image-meta support for %s/%s, using defaults: %s", pool, name, err)
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+	all, err := parseRBDImageMeta(out)
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]string{}
+	for key, value := range all {
+		if strings.HasPrefix(key, imageMetaPrefix) {
+			meta[strings.TrimPrefix(key, imageMetaPrefix)] = value
+		}
+	}
+	return meta, nil
+}
+
+// isImageMetaUnsupported checks for rbd without the image-meta command (before
+// infernalis), or OSDs and format 1 images without image-meta support
+func isImageMetaUnsupported(err error) bool {
+	cmdErr, ok := err.(CmdError)
+	if !ok {
+		return false
+	}
+	return cmdErr.ExitCode == int(syscall.EOPNOTSUPP) || cmdErr.ExitCode == int(syscall.ENOSYS) ||
+		strings.Contains(cmdErr.Stderr, "error parsing command")
+}
+
+// setImageMeta stores one of our settings with the image
+func (d *cephRBDVolumeDriver) setImageMeta(pool, name, key, value string) error {
+	_, err := d.rbdsh(pool, "image-meta", "set", name, imageMetaPrefix+key, value)
+	if err != nil {
+		return wrapVolumeError(err, "Unable to set image-meta %s on %s/%s", key, pool, name)
+	}
+	return nil
+}
+
+// removeImageMeta drops one of our settings from the image, if set
+func (d *cephRBDVolumeDriver) removeImageMeta(pool, name, key string) error {
+	_, err := d.rbdsh(pool, "image-meta", "remove", name, imageMetaPrefix+key)
+	if err != nil && !isExitCode(err, syscall.ENOENT) {
+		return wrapVolumeError(err, "Unable to remove image-meta %s from %s/%s", key, pool, name)
+	}
+	return nil
+}
+
+// The volume* helpers below take the image-meta Mount read once: if it can't
+// be read Mount fails, rather than mount a volume without its settings, e.g.
+// read-write while other hosts have it mounted read-only, or without the
+// nosuid/nodev of its mount options.
+
+// volumeLockWait returns how long Mount waits for another host to release the
+// image lock: the volume lock-wait setting, or the --lock-wait default
+func volumeLockWait(pool, name string, meta map[string]string) time.Duration {
+	if value, ok := meta[metaLockWait]; ok {
+		wait, err := time.ParseDuration(value)
+		if err == nil {
+			return wait
+		}
+		log.Printf("WARN: invalid %s %q on %s/%s, using default: %s", metaLockWait, value, pool, name, err)
+	}
+	return *lockWait
+}
+
+// volumeReadOnly tells if the volume is a read-only shared volume
+func volumeReadOnly(meta map[string]string) bool {
+	return meta[metaAccess] == accessReadOnly
+}
+
+// volumeFSPolicy returns what Mount does about filesystem errors: the volume
+// fs-policy setting, or the --fs-policy default
+func volumeFSPolicy(pool, name string, meta map[string]string) fsPolicy {
+	if value, ok := meta[metaFSPolicy]; ok {
+		if contains(VALID_FS_POLICIES, value) {
+			return fsPolicy(value)
+		}
+		log.Printf("WARN: invalid %s %q on %s/%s, using default", metaFSPolicy, value, pool, name)
+	}
+	return fsPolicyFlag
+}
@@ -0,0 +1,54 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"sync"
+)
+
+// volumeLocks serializes API operations on the same pool/image, while
+// operations on different volumes can run in parallel (e.g. a slow mkfs or
+// xfs_repair only blocks requests for that one volume)
+type volumeLocks struct {
+	m     sync.Mutex // guards locks map
+	locks map[string]*volumeLock
+}
+
+// volumeLock is a mutex with a count of users, so the map entry can be
+// dropped once nobody holds or waits for it
+type volumeLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{locks: map[string]*volumeLock{}}
+}
+
+// lock blocks until we hold the lock for pool/name, returns func to unlock it
+func (l *volumeLocks) lock(pool, name string) func() {
+	key := pool + "/" + name
+
+	l.m.Lock()
+	vl, ok := l.locks[key]
+	if !ok {
+		vl = &volumeLock{}
+		l.locks[key] = vl
+	}
+	vl.refs++
+	l.m.Unlock()
+
+	vl.Lock()
+
+	return func() {
+		vl.Unlock()
+
+		l.m.Lock()
+		vl.refs--
+		if vl.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.m.Unlock()
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeLocks_otherVolumeNotBlocked(t *testing.T) {
+	locks := newVolumeLocks()
+	unlock := locks.lock("rbd", "slow")
+	defer unlock()
+
+	done := make(chan bool)
+	go func() {
+		locks.lock("rbd", "fast")()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lock on other volume was blocked")
+	}
+}
+
+func TestVolumeLocks_sameVolumeSerialized(t *testing.T) {
+	locks := newVolumeLocks()
+	unlock := locks.lock("rbd", "foo")
+
+	done := make(chan bool)
+	go func() {
+		locks.lock("rbd", "foo")()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("second lock on same volume was not blocked")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	<-done
+
+	// all users gone - entry cleaned up
+	assert.Equal(t, 0, len(locks.locks), "Expected no leftover lock entries")
+}
@@ -13,13 +13,18 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 )
 
 var (
 	VALID_REMOVE_ACTIONS = []string{"ignore", "delete", "rename"}
+	VALID_LOCK_MODES     = []string{lockModeAdvisory, lockModeExclusive}
+	VALID_FS_POLICIES    = []string{fsPolicyNone, fsPolicyCheck, fsPolicyReplay, fsPolicyAutoRepair}
 
 	// Plugin Option Flags
 	versionFlag        = flag.Bool("version", false, "Print version")
@@ -32,9 +37,19 @@ var (
 	pluginDir          = flag.String("plugins", "/run/docker/plugins", "Docker plugin directory for socket")
 	rootMountDir       = flag.String("mount", volume.DefaultDockerRootDirectory, "Mount directory for volumes on host")
 	logDir             = flag.String("logdir", "/var/log", "Logfile directory")
+	stateDir           = flag.String("statedir", "/var/lib/rbd-docker-plugin", "Directory to persist mounted volume state across restarts")
 	canCreateVolumes   = flag.Bool("create", false, "Can auto Create RBD Images")
 	defaultImageSizeMB = flag.Int("size", 20*1024, "RBD Image size to Create (in MB) (default: 20480=20GB)")
 	defaultImageFSType = flag.String("fs", "xfs", "FS type for the created RBD Image (must have mkfs.type)")
+	breakStaleLocks    = flag.Bool("break-stale-locks", false, "Break image locks of other hosts that had no watchers for --stale-lock-grace, after blocklisting the lock holder's kernel client")
+	staleLockGrace     = flag.Duration("stale-lock-grace", 2*time.Minute, "How long a lock holder without a heartbeat lease must have no watchers before its lock is broken, timed by this plugin from the first Mount that finds it (see --lock-wait)")
+	heartbeatInterval  = flag.Duration("heartbeat-interval", 30*time.Second, "How often to renew the lease (image-meta heartbeat) on held images, 0 to disable")
+	leaseTTL           = flag.Duration("lease-ttl", 2*time.Minute, "How long a heartbeat lease is valid, should be a few heartbeat intervals")
+	cephFailures       = flag.Int("ceph-failures", 3, "Ceph connection failures or timeouts in a row before failing fast until the cluster responds again, 0 to disable")
+	cephProbeInterval  = flag.Duration("ceph-probe-interval", 15*time.Second, "How often to check if Ceph responds again while failing fast")
+	growOnMount        = flag.Bool("grow-on-mount", true, "Grow filesystems on Mount when their device is bigger, e.g. after rbd resize")
+	allowedMountOpts   = flag.String("mount-options-allowed", defaultMountOptionsAllowed, "Mount options volumes may set with the mount-options create option (comma separated names, or name=value to allow only that value)")
+	lockWait           = flag.Duration("lock-wait", 0, "How long Mount waits for another host to release the image lock, e.g. 30s (default: fail right away)")
 )
 
 // setup a validating flag for remove action
@@ -63,8 +78,72 @@ func contains(vals []string, check string) bool {
 
 var removeActionFlag removeAction = "ignore"
 
+// setup a validating flag for lock mode
+type lockMode string
+
+func (m *lockMode) String() string {
+	return string(*m)
+}
+
+func (m *lockMode) Set(value string) error {
+	if !contains(VALID_LOCK_MODES, value) {
+		return errors.New(fmt.Sprintf("Invalid value: %s, valid values are: %q", value, VALID_LOCK_MODES))
+	}
+	*m = lockMode(value)
+	return nil
+}
+
+var lockModeFlag lockMode = lockModeAdvisory
+
+// setup a validating flag for the filesystem check policy
+type fsPolicy string
+
+func (p *fsPolicy) String() string {
+	return string(*p)
+}
+
+func (p *fsPolicy) Set(value string) error {
+	if !contains(VALID_FS_POLICIES, value) {
+		return errors.New(fmt.Sprintf("Invalid value: %s, valid values are: %q", value, VALID_FS_POLICIES))
+	}
+	*p = fsPolicy(value)
+	return nil
+}
+
+var fsPolicyFlag fsPolicy = fsPolicyReplay
+
+// setup a repeatable flag for options per fstype, given as fstype:options
+type fsOptions map[string]string
+
+func (o fsOptions) String() string {
+	values := []string{}
+	for fstype, options := range o {
+		values = append(values, fstype+":"+options)
+	}
+	sort.Strings(values)
+	return strings.Join(values, " ")
+}
+
+func (o fsOptions) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.New(fmt.Sprintf("Invalid value: %s, expected fstype:options", value))
+	}
+	o[parts[0]] = parts[1]
+	return nil
+}
+
+var mountOptionsFlag = fsOptions{}
+var mkfsOptionsFlag = fsOptions{}
+var mkfsAllowedFlag = defaultMkfsOptionsAllowed()
+
 func init() {
 	flag.Var(&removeActionFlag, "remove", "Action to take on Remove: ignore, delete or rename")
+	flag.Var(&lockModeFlag, "lock-mode", "Image locking: advisory (rbd lock) or exclusive (exclusive-lock image feature, rbd map -o exclusive)")
+	flag.Var(mkfsOptionsFlag, "mkfs-options", "Default mkfs arguments for an fstype, e.g. \"xfs:-m reflink=1\" (repeat for more fstypes)")
+	flag.Var(mkfsAllowedFlag, "mkfs-options-allowed", "mkfs flags volumes may pass with the mkfs-options create option for an fstype, e.g. ext4:-b,-L,-m (repeat for more fstypes, replaces the fstype's default)")
+	flag.Var(mountOptionsFlag, "mount-options", "Default mount options for an fstype, e.g. xfs:noatime,nobarrier (repeat for more fstypes)")
+	flag.Var(&fsPolicyFlag, "fs-policy", "What Mount does about filesystem errors: none, check, replay (mount/unmount) or auto-repair")
 	flag.Parse()
 }
 
@@ -76,6 +155,18 @@ func logfilePath() string {
 	return filepath.Join(*logDir, *pluginName+"-docker-plugin.log")
 }
 
+func statefilePath() string {
+	return filepath.Join(*stateDir, *pluginName+"-volumes.json")
+}
+
+func lockAuditLogPath() string {
+	return filepath.Join(*logDir, *pluginName+"-lock-audit.log")
+}
+
+func repairLogDirPath() string {
+	return filepath.Join(*logDir, *pluginName+"-repair")
+}
+
 func main() {
 	if *versionFlag {
 		fmt.Printf("%s\n", VERSION)
@@ -89,15 +180,16 @@ func main() {
 	defer shutdownLogging(logFile)
 
 	log.Printf("INFO: starting rbd-docker-plugin version %s", VERSION)
-	log.Printf("INFO: canCreateVolumes=%v, removeAction=%q", *canCreateVolumes, removeActionFlag)
+	log.Printf("INFO: canCreateVolumes=%v, removeAction=%q, lockMode=%q, fsPolicy=%q", *canCreateVolumes, removeActionFlag, lockModeFlag, fsPolicyFlag)
 	log.Printf(
-		"INFO: Setting up Ceph Driver for PluginID=%s, cluster=%s, ceph-user=%s, pool=%s, mount=%s, config=%s",
+		"INFO: Setting up Ceph Driver for PluginID=%s, cluster=%s, ceph-user=%s, pool=%s, mount=%s, config=%s, state=%s",
 		*pluginName,
 		*cephCluster,
 		*cephUser,
 		*defaultCephPool,
 		*rootMountDir,
 		*cephConfigFile,
+		statefilePath(),
 	)
 
 	// double check for config file - required especially for non-standard configs
@@ -116,8 +208,34 @@ func main() {
 		*defaultCephPool,
 		*rootMountDir,
 		*cephConfigFile,
+		statefilePath(),
 	)
 
+	d.lockAuditLog = lockAuditLogPath()
+	d.repairLogDir = repairLogDirPath()
+	if *breakStaleLocks {
+		log.Printf("INFO: breaking stale locks after %s without watchers, recorded in %s", *staleLockGrace, d.lockAuditLog)
+		// the grace period is timed from the first Mount that runs into the lock
+		if *lockWait < *staleLockGrace {
+			log.Printf("WARN: --lock-wait %s is shorter than --stale-lock-grace %s: locks of holders without a heartbeat lease are only broken by a Mount after the grace period, set --lock-wait >= --stale-lock-grace (or lock-wait per volume) to take them over within one Mount", *lockWait, *staleLockGrace)
+		}
+	}
+
+	// check what is really mapped/mounted/locked on this host before serving requests
+	report, err := d.reconcile()
+	if err != nil {
+		log.Printf("WARN: unable to reconcile mounted volumes, using saved state: %s", err)
+	} else if report.orphans() > 0 {
+		log.Printf("WARN: reconcile found orphaned volumes needing manual cleanup: mapped but not mounted=%q, mounted but not locked=%q, locked but not mapped=%q",
+			report.MappedNotMounted, report.MountedNotLocked, report.LockedNotMapped)
+	}
+	// locks an Unmount couldn't release before we stopped
+	d.releasePendingUnlocks()
+
+	// keep the leases on our locks alive
+	stopHeartbeat := d.startHeartbeat()
+	defer stopHeartbeat()
+
 	log.Println("INFO: Creating Docker VolumeDriver Handler")
 	h := volume.NewHandler(d)
 
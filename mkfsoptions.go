@@ -0,0 +1,99 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// mkfs arguments for new images: plugin defaults per fstype (--mkfs-options
+// "xfs:-m reflink=1"), followed by those of the volume (mkfs-options create
+// option). Volume arguments are checked against the --mkfs-options-allowed
+// flags of the fstype, and may not name other files or devices, so only the
+// filesystem on the new image is made. The arguments used are kept with the
+// image as image-meta.
+
+import (
+	"strings"
+)
+
+// flags volumes may pass to mkfs by default, per fstype: block/inode sizes and
+// counts, label, features and tuning. Never force (-f/-F), superblock only
+// (mke2fs -S), bad block lists (mke2fs -c/-l), a directory to copy in (mke2fs
+// -d, mkfs.btrfs -r) or dry runs that make nothing (mke2fs -n, mkfs.xfs -N).
+// Fstypes not listed may pass none.
+const extMkfsOptionsAllowed = "-b,-i,-I,-L,-m,-N,-O,-E,-T"
+
+func defaultMkfsOptionsAllowed() fsOptions {
+	return fsOptions{
+		"xfs":   "-b,-d,-i,-l,-L,-m,-n,-s",
+		"ext2":  extMkfsOptionsAllowed,
+		"ext3":  extMkfsOptionsAllowed,
+		"ext4":  extMkfsOptionsAllowed,
+		"btrfs": "-d,-m,-n,-s,-L,-O,-R,-M",
+	}
+}
+
+// mkfs flags taking no value, per fstype: what follows them is another
+// argument, e.g. a second device after mkfs.btrfs -M
+var mkfsBoolFlags = map[string][]string{
+	"xfs":   {"-f", "-K", "-N", "-q"},
+	"ext2":  {"-c", "-D", "-F", "-j", "-n", "-q", "-S", "-v"},
+	"ext3":  {"-c", "-D", "-F", "-j", "-n", "-q", "-S", "-v"},
+	"ext4":  {"-c", "-D", "-F", "-j", "-n", "-q", "-S", "-v"},
+	"btrfs": {"-f", "-K", "-M", "-q", "-v"},
+}
+
+// keys of -d/-l/-E style values naming another file or device
+var mkfsDeniedKeys = []string{"name", "file", "logdev", "rtdev", "device"}
+
+// parseMkfsOptions splits mkfs arguments on whitespace
+func parseMkfsOptions(value string) []string {
+	return strings.Fields(value)
+}
+
+// checkMkfsOptions refuses flags not on the --mkfs-options-allowed list of the
+// fstype, arguments not following a flag taking a value (a second device) and
+// values naming other files or devices
+func checkMkfsOptions(fstype string, args []string) error {
+	allowed := parseMountOptions(mkfsAllowedFlag[fstype])
+	denied := []string{}
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			if !contains(allowed, arg) {
+				denied = append(denied, arg)
+			}
+			continue
+		}
+		if i == 0 || !mkfsFlagTakesValue(fstype, args[i-1]) || mkfsValueDenied(arg) {
+			denied = append(denied, arg)
+		}
+	}
+	if len(denied) > 0 {
+		return newVolumeError(KindPolicyDenied, nil, "mkfs options %q not allowed for %s, see --mkfs-options-allowed", denied, fstype)
+	}
+	return nil
+}
+
+// mkfsFlagTakesValue tells if the argument is a flag followed by its value
+func mkfsFlagTakesValue(fstype, arg string) bool {
+	return strings.HasPrefix(arg, "-") && !contains(mkfsBoolFlags[fstype], arg)
+}
+
+// mkfsValueDenied checks a flag value for paths, or keys naming a file or
+// device, e.g. -d name=/dev/sdb
+func mkfsValueDenied(value string) bool {
+	if strings.Contains(value, "/") {
+		return true
+	}
+	for _, pair := range strings.Split(value, ",") {
+		key := strings.SplitN(pair, "=", 2)[0]
+		if contains(mkfsDeniedKeys, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// volumeMkfsArgs returns the arguments to make a new filesystem with: the
+// --mkfs-options default for the fstype, then those of the volume
+func volumeMkfsArgs(fstype string, options []string) []string {
+	return append(parseMkfsOptions(mkfsOptionsFlag[fstype]), options...)
+}
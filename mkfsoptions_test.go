@@ -0,0 +1,134 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckMkfsOptions(t *testing.T) {
+	allowed := map[string][][]string{
+		"xfs": {
+			{},
+			{"-i", "size=512", "-L", "data"},
+			{"-m", "reflink=1,crc=1"},
+			{"-d", "su=64k,sw=4"},
+		},
+		"ext4": {
+			{},
+			{"-m", "1", "-O", "^has_journal", "-E", "lazy_itable_init=0"},
+		},
+		"btrfs": {
+			{"-m", "dup", "-L", "data"},
+			{"-M", "-L", "data"},
+		},
+	}
+	for fstype, cases := range allowed {
+		for _, args := range cases {
+			assert.Nil(t, checkMkfsOptions(fstype, args), "Expected %q to be allowed for %s", args, fstype)
+		}
+	}
+
+	denied := map[string][][]string{
+		"xfs": {
+			{"-f"},
+			{"-N"},
+			{"-L", "data", "/dev/sdb"},
+			{"/dev/sdb"},
+			{"-d", "name=/dev/sdb"},
+			{"-d", "file=1,name=img"},
+			{"-l", "logdev=sdb1"},
+			{"-L", "../etc"},
+		},
+		"ext4": {
+			{"-F", "-S"},
+			// copies the directory etc in as the root directory
+			{"-d", "etc"},
+			// dry run, makes nothing
+			{"-n"},
+			// reads a bad blocks list from a file
+			{"-l", "badblocks"},
+		},
+		"btrfs": {
+			{"-r", "etc"},
+			// -M takes no value: a second device
+			{"-M", "/dev/x"},
+			{"-M", "sdb"},
+		},
+		// no allowlist
+		"vfat": {
+			{"-n", "data"},
+		},
+	}
+	for fstype, cases := range denied {
+		for _, args := range cases {
+			assertErrorKind(t, KindPolicyDenied, checkMkfsOptions(fstype, args))
+		}
+	}
+}
+
+func TestCheckMkfsOptions_flag(t *testing.T) {
+	defer func(ext4 string) { mkfsAllowedFlag["ext4"] = ext4 }(mkfsAllowedFlag["ext4"])
+	assert.Nil(t, mkfsAllowedFlag.Set("ext4:-L"))
+	assert.Nil(t, checkMkfsOptions("ext4", []string{"-L", "data"}))
+	assertErrorKind(t, KindPolicyDenied, checkMkfsOptions("ext4", []string{"-m", "1"}))
+	// other fstypes keep their default
+	assert.Nil(t, checkMkfsOptions("xfs", []string{"-m", "reflink=1"}))
+}
+
+func TestCreate_mkfsOptions(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	*canCreateVolumes = true
+	defer func() { *canCreateVolumes = false }()
+	mkfsOptionsFlag["xfs"] = "-m reflink=1"
+	defer delete(mkfsOptionsFlag, "xfs")
+
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"mkfs-options": "-i size=512 -L data"}})
+	assert.Nil(t, err, formatError("Create", err))
+	assert.Equal(t, 1, fake.countCalls("mkfs.xfs -m reflink=1 -i size=512 -L data /dev/rbd0"), "Expected default and volume mkfs arguments")
+	assert.Equal(t, "-m reflink=1 -i size=512 -L data", fake.image("rbd", "foo").meta[imageMetaPrefix+metaMkfsOptions])
+
+	// no arguments, nothing to record
+	err = d.Create(&volume.CreateRequest{Name: "bar", Options: map[string]string{"fstype": "ext4"}})
+	assert.Nil(t, err, formatError("Create", err))
+	assert.Equal(t, 1, fake.countCalls("mkfs.ext4 /dev/rbd0"))
+	_, ok := fake.image("rbd", "bar").meta[imageMetaPrefix+metaMkfsOptions]
+	assert.False(t, ok, "Expected no mkfs-options image-meta")
+}
+
+func TestCreate_mkfsOptionsDenied(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	*canCreateVolumes = true
+	defer func() { *canCreateVolumes = false }()
+
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"mkfs-options": "-f -d name=/dev/sdb"}})
+	assertErrorKind(t, KindPolicyDenied, err)
+	assert.Nil(t, fake.image("rbd", "foo"), "Expected no image to be created")
+
+	// allowed for xfs, not for ext4
+	err = d.Create(&volume.CreateRequest{Name: "bar", Options: map[string]string{"fstype": "ext4", "mkfs-options": "-d etc"}})
+	assertErrorKind(t, KindPolicyDenied, err)
+	assert.Nil(t, fake.image("rbd", "bar"), "Expected no image to be created")
+	assert.Equal(t, 0, fake.countCalls("mkfs."))
+}
+
+func TestCreate_mkfsOptionsExistingImage(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	*canCreateVolumes = true
+	defer func() { *canCreateVolumes = false }()
+
+	// made as ext4 long ago: its mkfs-options are neither checked nor used
+	fake.addImage("rbd", "foo", "ext4")
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"mkfs-options": "-O ^has_journal"}})
+	assert.Nil(t, err, formatError("Create", err))
+	assert.Equal(t, 0, fake.countCalls("mkfs."))
+	_, ok := fake.image("rbd", "foo").meta[imageMetaPrefix+metaMkfsOptions]
+	assert.False(t, ok, "Expected no mkfs-options image-meta")
+}
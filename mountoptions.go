@@ -0,0 +1,66 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Mount options: plugin defaults per fstype (--mount-options xfs:noatime),
+// followed by those of the volume (mount-options create option, kept as
+// image-meta), so the volume ones win. Only options on the
+// --mount-options-allowed list can be set on a volume, anything changing
+// how the plugin mounts (ro, norecovery, suid, ...) stays out of reach.
+
+import (
+	"strings"
+)
+
+// options volumes may use by default: atime, discard and write barrier
+// tuning, restrictions, and harmless xfs/ext4/btrfs tuning. A name allows any
+// value, name=value only that one: errors=panic would take the host down,
+// data=writeback risks stale data in files after a crash.
+const defaultMountOptionsAllowed = "noatime,nodiratime,relatime,lazytime,nosuid,nodev,noexec," +
+	"discard,nodiscard,nobarrier,inode64,largeio,allocsize,logbufs,logbsize,commit," +
+	"data=ordered,data=journal,errors=remount-ro,errors=continue," +
+	"compress,compress-force,ssd,space_cache,autodefrag"
+
+// parseMountOptions splits comma separated mount options, dropping empty ones
+func parseMountOptions(value string) []string {
+	options := []string{}
+	for _, option := range strings.Split(value, ",") {
+		option = strings.TrimSpace(option)
+		if option != "" {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// checkMountOptions refuses options not on the --mount-options-allowed list:
+// neither their name (the part before any =) nor, for name=value entries,
+// the whole option
+func checkMountOptions(options []string) error {
+	allowed := parseMountOptions(*allowedMountOpts)
+	denied := []string{}
+	for _, option := range options {
+		name := strings.SplitN(option, "=", 2)[0]
+		if (!contains(allowed, name) && !contains(allowed, option)) || strings.ContainsAny(option, " \t\n") {
+			denied = append(denied, option)
+		}
+	}
+	if len(denied) > 0 {
+		return newVolumeError(KindPolicyDenied, nil, "Mount options %q not allowed, see --mount-options-allowed", denied)
+	}
+	return nil
+}
+
+// volumeMountOptions returns the options to mount a volume with: the
+// --mount-options default for its fstype, then its own mount-options
+func volumeMountOptions(fstype string, meta map[string]string) ([]string, error) {
+	options := parseMountOptions(mountOptionsFlag[fstype])
+	volumeOptions := parseMountOptions(meta[metaMountOptions])
+	// checked on Create, but the allowlist may have changed since
+	err := checkMountOptions(volumeOptions)
+	if err != nil {
+		return nil, err
+	}
+	return append(options, volumeOptions...), nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	assert.Equal(t, []string{}, parseMountOptions(""))
+	assert.Equal(t, []string{"noatime", "logbsize=256k"}, parseMountOptions(" noatime,, logbsize=256k,"))
+}
+
+func TestCheckMountOptions(t *testing.T) {
+	assert.Nil(t, checkMountOptions([]string{"noatime", "discard", "commit=60", "data=ordered"}))
+	assertErrorKind(t, KindPolicyDenied, checkMountOptions([]string{"noatime", "suid"}))
+	assertErrorKind(t, KindPolicyDenied, checkMountOptions([]string{"norecovery"}))
+	assertErrorKind(t, KindPolicyDenied, checkMountOptions([]string{"commit=60 -o suid"}))
+
+	// only the values on the list
+	assert.Nil(t, checkMountOptions([]string{"errors=remount-ro", "data=journal"}))
+	assertErrorKind(t, KindPolicyDenied, checkMountOptions([]string{"errors=panic"}))
+	assertErrorKind(t, KindPolicyDenied, checkMountOptions([]string{"data=writeback"}))
+	assertErrorKind(t, KindPolicyDenied, checkMountOptions([]string{"errors"}))
+}
+
+func TestFSOptionsFlag(t *testing.T) {
+	o := fsOptions{}
+	assert.Nil(t, o.Set("xfs:noatime,nobarrier"))
+	assert.Nil(t, o.Set("ext4:data=ordered"))
+	assert.NotNil(t, o.Set("noatime"))
+	assert.NotNil(t, o.Set(":noatime"))
+	assert.Equal(t, "ext4:data=ordered xfs:noatime,nobarrier", o.String())
+}
+
+func TestMount_mountOptions(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	mountOptionsFlag["xfs"] = "noatime,nobarrier"
+	defer delete(mountOptionsFlag, "xfs")
+	fake.addImage("rbd", "foo", "xfs")
+	fake.addImage("rbd", "bar", "ext4")
+
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"mount-options": "discard,relatime"}})
+	assert.Nil(t, err, formatError("Create", err))
+	assert.Equal(t, "discard,relatime", fake.image("rbd", "foo").meta[imageMetaPrefix+metaMountOptions])
+
+	// plugin default for the fstype first, the volume ones win
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, "noatime,nobarrier,discard,relatime", fake.options[d.mountpoint("rbd", "foo")])
+
+	// no default for ext4
+	_, err = d.Mount(&volume.MountRequest{Name: "bar", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, "", fake.options[d.mountpoint("rbd", "bar")])
+}
+
+func TestMount_mountOptionsMetaUnreadable(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	img := fake.addImage("rbd", "foo", "xfs")
+
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"mount-options": "nosuid,nodev"}})
+	assert.Nil(t, err, formatError("Create", err))
+	reads := fake.countCalls("rbd --pool rbd --conf  --id admin image-meta list foo")
+
+	// don't mount it without its nosuid,nodev
+	img.metaErr = true
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assertErrorKind(t, KindInternal, err)
+	assert.Equal(t, 0, len(fake.mapped), "Expected nothing mapped")
+	assert.Equal(t, 0, len(img.locks), "Expected no lock")
+
+	// image-meta is read once per Mount
+	img.metaErr = false
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, "nosuid,nodev", fake.options[d.mountpoint("rbd", "foo")])
+	assert.Equal(t, reads+2, fake.countCalls("rbd --pool rbd --conf  --id admin image-meta list foo"), "Expected one image-meta read per Mount")
+}
+
+func TestMount_mountOptionsReadOnly(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	fake.addImage("rbd", "foo", "xfs")
+
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"access": "ro", "mount-options": "noatime"}})
+	assert.Nil(t, err, formatError("Create", err))
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, "ro,norecovery,noatime", fake.options[d.mountpoint("rbd", "foo")])
+}
+
+func TestMountOptions_denied(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	img := fake.addImage("rbd", "foo", "xfs")
+
+	err := d.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"mount-options": "noatime,suid"}})
+	assertErrorKind(t, KindPolicyDenied, err)
+	assert.Equal(t, 0, len(img.meta), "Expected no image-meta to be set")
+
+	// set by hand, or no longer allowed: refused on Mount
+	assert.Nil(t, d.setImageMeta("rbd", "foo", metaMountOptions, "noatime,dev"))
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assertErrorKind(t, KindPolicyDenied, err)
+	assert.Equal(t, 0, len(fake.mapped), "Expected image to be unmapped again")
+	assert.Equal(t, 0, len(img.locks), "Expected image to be unlocked again")
+}
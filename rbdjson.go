@@ -0,0 +1,241 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Typed parsing of `rbd ... --format json` output.
+//
+// Several commands changed their JSON layout between Ceph releases, e.g. in
+// Nautilus `lock list` and `showmapped` went from an object keyed on lock or
+// device id to an array, so the parsers here accept both.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// rbdImage is one entry of `rbd ls -l`, snapshots are listed as their own entries
+type rbdImage struct {
+	Image    string `json:"image"`
+	Snapshot string `json:"snapshot"`
+	Size     uint64 `json:"size"`
+	Format   int    `json:"format"`
+	LockType string `json:"lock_type"` // exclusive or shared, empty if not locked
+}
+
+// rbdImageInfo is the output of `rbd info`
+type rbdImageInfo struct {
+	Name       string   `json:"name"`
+	ID         string   `json:"id"` // luminous and later
+	Size       uint64   `json:"size"`
+	Objects    uint64   `json:"objects"`
+	Order      int      `json:"order"`
+	ObjectSize uint64   `json:"object_size"`
+	Format     int      `json:"format"`
+	Features   []string `json:"features"`
+	Flags      []string `json:"flags"`
+}
+
+// rbdLock is one lock holder from `rbd lock list`
+type rbdLock struct {
+	ID      string `json:"id"`      // lock cookie
+	Locker  string `json:"locker"`  // client.id
+	Address string `json:"address"` // client address
+}
+
+// rbdMapping is one kernel device from `rbd showmapped`
+type rbdMapping struct {
+	ID        string `json:"id"`
+	Pool      string `json:"pool"`
+	Namespace string `json:"namespace"` // nautilus and later
+	Image     string `json:"name"`
+	Snap      string `json:"snap"`
+	Device    string `json:"device"`
+}
+
+// rbdWatcher is one watcher of an image from `rbd status`
+type rbdWatcher struct {
+	Address string `json:"address"`
+	Client  uint64 `json:"client"`
+	Cookie  uint64 `json:"cookie"`
+}
+
+// parseRBDList parses `rbd ls -l --format json`
+func parseRBDList(out string) ([]rbdImage, error) {
+	images := []rbdImage{}
+	if err := unmarshalRBD("ls", out, &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// parseRBDInfo parses `rbd info --format json`
+func parseRBDInfo(out string) (*rbdImageInfo, error) {
+	info := &rbdImageInfo{}
+	if err := unmarshalRBD("info", out, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// parseRBDLocks parses `rbd lock list --format json`:
+//
+//	jewel/luminous: {"<id>": {"locker": "client.4123", "address": "..."}}
+//	nautilus+:      [{"id": "<id>", "locker": "client.4123", "address": "..."}]
+func parseRBDLocks(out string) ([]rbdLock, error) {
+	locks := []rbdLock{}
+	if isJSONObject(out) {
+		byID := map[string]rbdLock{}
+		if err := unmarshalRBD("lock list", out, &byID); err != nil {
+			return nil, err
+		}
+		for id, lock := range byID {
+			lock.ID = id
+			locks = append(locks, lock)
+		}
+		sort.Slice(locks, func(i, j int) bool { return locks[i].ID < locks[j].ID })
+		return locks, nil
+	}
+	if err := unmarshalRBD("lock list", out, &locks); err != nil {
+		return nil, err
+	}
+	return locks, nil
+}
+
+// parseRBDShowMapped parses `rbd showmapped --format json`:
+//
+//	jewel/luminous: {"0": {"pool": "rbd", "name": "foo", "snap": "-", "device": "/dev/rbd0"}}
+//	nautilus+:      [{"id": "0", "pool": "rbd", "namespace": "", "name": "foo", ...}]
+func parseRBDShowMapped(out string) ([]rbdMapping, error) {
+	mappings := []rbdMapping{}
+	if isJSONObject(out) {
+		byID := map[string]rbdMapping{}
+		if err := unmarshalRBD("showmapped", out, &byID); err != nil {
+			return nil, err
+		}
+		for id, m := range byID {
+			m.ID = id
+			mappings = append(mappings, m)
+		}
+		sort.Slice(mappings, func(i, j int) bool { return mappings[i].ID < mappings[j].ID })
+		return mappings, nil
+	}
+	if err := unmarshalRBD("showmapped", out, &mappings); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// parseRBDStatus parses the watchers from `rbd status --format json`:
+//
+//	{"watchers": [{"address": "...", "client": 4123, "cookie": 1}]}
+//
+// older releases nest them in a "watcher" object (single or list) instead
+func parseRBDStatus(out string) ([]rbdWatcher, error) {
+	status := struct {
+		Watchers json.RawMessage `json:"watchers"`
+	}{}
+	if err := unmarshalRBD("status", out, &status); err != nil {
+		return nil, err
+	}
+
+	watchers := []rbdWatcher{}
+	raw := status.Watchers
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return watchers, nil
+	}
+	if isJSONObject(string(raw)) {
+		nested := struct {
+			Watcher json.RawMessage `json:"watcher"`
+		}{}
+		if err := unmarshalRBD("status", string(raw), &nested); err != nil {
+			return nil, err
+		}
+		raw = nested.Watcher
+		if len(bytes.TrimSpace(raw)) == 0 {
+			return watchers, nil
+		}
+		if isJSONObject(string(raw)) {
+			w := rbdWatcher{}
+			if err := unmarshalRBD("status", string(raw), &w); err != nil {
+				return nil, err
+			}
+			return append(watchers, w), nil
+		}
+	}
+	if err := unmarshalRBD("status", string(raw), &watchers); err != nil {
+		return nil, err
+	}
+	return watchers, nil
+}
+
+// unmarshalRBD decodes rbd JSON output, treating empty output as empty JSON
+func unmarshalRBD(command, out string, v interface{}) error {
+	data := bytes.TrimSpace([]byte(out))
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("unable to parse rbd %s output: %s", command, err)
+	}
+	return nil
+}
+
+func isJSONObject(out string) bool {
+	data := bytes.TrimSpace([]byte(out))
+	return len(data) > 0 && data[0] == '{'
+}
+
+// rbdshJSON calls rbd like rbdsh, asking for JSON output
+func (d *cephRBDVolumeDriver) rbdshJSON(pool, command string, args ...string) (string, error) {
+	return d.rbdsh(pool, command, append(args, "--format", "json")...)
+}
+
+// rbdImageInfo returns `rbd info` for the image
+func (d *cephRBDVolumeDriver) rbdImageInfo(pool, name string) (*rbdImageInfo, error) {
+	out, err := d.rbdshJSON(pool, "info", name)
+	if err != nil {
+		return nil, err
+	}
+	return parseRBDInfo(out)
+}
+
+// rbdLockList returns all current lock holders of the image
+func (d *cephRBDVolumeDriver) rbdLockList(pool, name string) ([]rbdLock, error) {
+	out, err := d.rbdshJSON(pool, "lock", "list", name)
+	if err != nil {
+		return nil, err
+	}
+	return parseRBDLocks(out)
+}
+
+// rbdShowMapped returns all rbd kernel devices on this host
+func (d *cephRBDVolumeDriver) rbdShowMapped() ([]rbdMapping, error) {
+	out, err := d.rbdshJSON("", "showmapped")
+	if err != nil {
+		return nil, err
+	}
+	return parseRBDShowMapped(out)
+}
+
+// rbdWatchers returns the clients watching the image, i.e. that have it open
+func (d *cephRBDVolumeDriver) rbdWatchers(pool, name string) ([]rbdWatcher, error) {
+	out, err := d.rbdshJSON(pool, "status", name)
+	if err != nil {
+		return nil, err
+	}
+	return parseRBDStatus(out)
+}
+
+// parseRBDImageMeta parses `rbd image-meta list --format json`:
+//
+//	{"key": "value", ...}
+func parseRBDImageMeta(out string) (map[string]string, error) {
+	meta := map[string]string{}
+	if err := unmarshalRBD("image-meta list", out, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
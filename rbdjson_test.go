@@ -0,0 +1,117 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recorded `rbd ... --format json` output, see testdata/rbd/<release>/
+var rbdReleases = []string{"hammer", "jewel", "luminous", "nautilus"}
+
+func readRBDFixture(t *testing.T, release, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "rbd", release, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParseRBDList(t *testing.T) {
+	for _, release := range rbdReleases {
+		images, err := parseRBDList(readRBDFixture(t, release, "ls-l.json"))
+		assert.Nil(t, err, formatError(release, err))
+		assert.Equal(t, 3, len(images), release)
+		assert.Equal(t, rbdImage{Image: "foo", Size: 1073741824, Format: 2, LockType: "exclusive"}, images[0], release)
+		assert.Equal(t, "snap1", images[1].Snapshot, release)
+		assert.Equal(t, "bar", images[2].Image, release)
+	}
+
+	images, err := parseRBDList("[]")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(images), "Expected no images in empty pool")
+	images, err = parseRBDList("")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(images), "Expected no images for empty output")
+}
+
+func TestParseRBDInfo(t *testing.T) {
+	for _, release := range rbdReleases {
+		info, err := parseRBDInfo(readRBDFixture(t, release, "info.json"))
+		assert.Nil(t, err, formatError(release, err))
+		assert.Equal(t, "foo", info.Name, release)
+		assert.Equal(t, uint64(1073741824), info.Size, release)
+		assert.Equal(t, 2, info.Format, release)
+		assert.Contains(t, info.Features, "layering", release)
+	}
+}
+
+func TestParseRBDLocks(t *testing.T) {
+	for _, release := range rbdReleases {
+		locks, err := parseRBDLocks(readRBDFixture(t, release, "lock-list.json"))
+		assert.Nil(t, err, formatError(release, err))
+		assert.Equal(t, []rbdLock{{ID: "node1", Locker: "client.4123", Address: "10.0.0.5:0/1234"}}, locks, release)
+	}
+
+	// not locked: older releases print nothing, newer an empty list
+	for _, out := range []string{"", "{}", "[]"} {
+		locks, err := parseRBDLocks(out)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(locks), "Expected no locks for %q", out)
+	}
+}
+
+func TestParseRBDShowMapped(t *testing.T) {
+	for _, release := range rbdReleases {
+		mappings, err := parseRBDShowMapped(readRBDFixture(t, release, "showmapped.json"))
+		assert.Nil(t, err, formatError(release, err))
+		assert.Equal(t, []rbdMapping{
+			{ID: "0", Pool: "rbd", Image: "foo", Snap: "-", Device: "/dev/rbd0"},
+			{ID: "1", Pool: "deep", Image: "bar", Snap: "-", Device: "/dev/rbd1"},
+		}, mappings, release)
+	}
+}
+
+func TestParseRBDStatus(t *testing.T) {
+	cookies := map[string]uint64{
+		"hammer":   1,
+		"jewel":    1,
+		"luminous": 18446462598732840961,
+		"nautilus": 18446462598732840961,
+	}
+	for _, release := range rbdReleases {
+		watchers, err := parseRBDStatus(readRBDFixture(t, release, "status.json"))
+		assert.Nil(t, err, formatError(release, err))
+		assert.Equal(t, []rbdWatcher{{Address: "10.0.0.5:0/1234", Client: 4123, Cookie: cookies[release]}}, watchers, release)
+	}
+
+	watchers, err := parseRBDStatus(`{"watchers":[]}`)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(watchers), "Expected no watchers")
+	watchers, err = parseRBDStatus(`{"watchers":{}}`)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(watchers), "Expected no watchers in old format")
+}
+
+func TestParseRBD_invalid(t *testing.T) {
+	_, err := parseRBDLocks("rbd: error opening image foo")
+	assert.NotNil(t, err, "Expected error for text output")
+}
+
+func TestParseRBDImageMeta(t *testing.T) {
+	// image-meta is not available in hammer
+	for _, release := range rbdReleases[1:] {
+		meta, err := parseRBDImageMeta(readRBDFixture(t, release, "image-meta-list.json"))
+		assert.Nil(t, err, formatError(release, err))
+		assert.Equal(t, map[string]string{"conf_rbd_cache": "false", "rbd-docker-plugin.lock-wait": "30s"}, meta, release)
+	}
+
+	meta, err := parseRBDImageMeta("")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(meta), "Expected no image-meta")
+}
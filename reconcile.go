@@ -0,0 +1,291 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Startup reconciliation of kernel state (rbd mappings, mounts) and Ceph
+// locks with our table of known volumes.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	mountInfoPath = "/proc/self/mountinfo"
+)
+
+// mountInfo is the subset of a /proc/self/mountinfo line we care about
+type mountInfo struct {
+	MountPoint string
+	FStype     string
+	Source     string
+}
+
+// reconcileReport lists what was found at startup, by pool/image
+type reconcileReport struct {
+	Adopted          []string // mapped and mounted by us: known volumes
+	MappedNotMounted []string // mapped to a kernel device but not mounted at our mountpoint
+	MountedNotLocked []string // mounted, but our lock is gone
+	LockedNotMapped  []string // still locked by us, but not mapped here anymore
+}
+
+func (r reconcileReport) orphans() int {
+	return len(r.MappedNotMounted) + len(r.MountedNotLocked) + len(r.LockedNotMapped)
+}
+
+// reconcile rebuilds the volumes map from what is actually mapped, mounted
+// and locked on this host, and reports anything that is only half set up.
+//
+// Volumes loaded from the state file are used to fill in what the kernel
+// can't tell us (mount IDs, locker cookie) and to find images we may still have
+// locked even though they are no longer mapped (e.g. after a reboot).
+func (d *cephRBDVolumeDriver) reconcile() (reconcileReport, error) {
+	report := reconcileReport{}
+
+	mappings, err := d.rbdShowMapped()
+	if err != nil {
+		return report, fmt.Errorf("unable to list mapped rbd devices: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(mountInfoPath)
+	if err != nil {
+		return report, fmt.Errorf("unable to read mounts: %s", err)
+	}
+	mounts := parseMountInfo(string(data))
+
+	// copy - we refill d.volumes in place, driver copies share the map
+	d.m.RLock()
+	known := map[string]*Volume{}
+	for mount, vol := range d.volumes {
+		known[mount] = vol
+	}
+	d.m.RUnlock()
+	volumes := map[string]*Volume{}
+	cookie := d.localLockerCookie()
+
+	mapped := map[string]bool{}
+	for _, m := range mappings {
+		if m.Snap != "" && m.Snap != "-" {
+			// we never map snapshots
+			continue
+		}
+		imagename := m.Pool + "/" + m.Image
+		mapped[imagename] = true
+		mount := d.mountpoint(m.Pool, m.Image)
+
+		var info *mountInfo
+		for i := range mounts {
+			if mounts[i].MountPoint == mount && d.sameDevice(mounts[i].Source, m) {
+				info = &mounts[i]
+				break
+			}
+		}
+		if info == nil {
+			log.Printf("WARN: reconcile: %s is mapped to %s but not mounted on %s", imagename, m.Device, mount)
+			report.MappedNotMounted = append(report.MappedNotMounted, imagename)
+			continue
+		}
+
+		vol := &Volume{
+			Name:   m.Image,
+			Device: m.Device,
+			FStype: info.FStype,
+			Pool:   m.Pool,
+		}
+		if prev, ok := known[mount]; ok {
+			vol.MountIDs = prev.MountIDs
+			vol.Locker = prev.Locker
+			vol.LockMode = prev.LockMode
+			vol.ReadOnly = prev.ReadOnly
+			vol.Client = prev.Client
+		} else {
+			// no state entry: tell from the image locks how we mapped it
+			vol.LockMode, vol.Locker = d.adoptedLockMode(m.Pool, m.Image)
+		}
+		if vol.LockMode == lockModeExclusive {
+			// the kernel client holds the lock for as long as it's mapped
+			log.Printf("INFO: reconcile: adopting %s on %s (%s), exclusive lock", imagename, mount, m.Device)
+			report.Adopted = append(report.Adopted, imagename)
+			volumes[mount] = vol
+			continue
+		}
+		if vol.ReadOnly {
+			log.Printf("INFO: reconcile: adopting %s on %s (%s), read-only", imagename, mount, m.Device)
+			report.Adopted = append(report.Adopted, imagename)
+			volumes[mount] = vol
+			continue
+		}
+
+		locker, err := d.rbdImageLockedBy(m.Pool, m.Image, vol.Locker)
+		if err != nil {
+			log.Printf("WARN: reconcile: unable to check lock on %s: %s", imagename, err)
+		} else if locker == "" {
+			log.Printf("WARN: reconcile: %s is mounted on %s but not locked by us", imagename, mount)
+			report.MountedNotLocked = append(report.MountedNotLocked, imagename)
+		} else {
+			vol.Locker = locker
+		}
+		if vol.Locker == "" {
+			vol.Locker = cookie
+		}
+		if vol.Client == "" {
+			vol.Client = d.kernelClient(m.Pool, m.Image)
+		}
+
+		log.Printf("INFO: reconcile: adopting %s on %s (%s)", imagename, mount, m.Device)
+		report.Adopted = append(report.Adopted, imagename)
+		volumes[mount] = vol
+	}
+
+	// anything we remember but is no longer mapped may have been left locked
+	for _, vol := range known {
+		imagename := vol.Pool + "/" + vol.Name
+		if mapped[imagename] || vol.LockMode == lockModeExclusive || vol.ReadOnly {
+			continue
+		}
+		locker, err := d.rbdImageLockedBy(vol.Pool, vol.Name, vol.Locker)
+		if err != nil {
+			log.Printf("WARN: reconcile: unable to check lock on %s: %s", imagename, err)
+			continue
+		}
+		if locker != "" {
+			log.Printf("WARN: reconcile: %s is locked by %s but not mapped", imagename, parseLockCookie(locker).describe())
+			report.LockedNotMapped = append(report.LockedNotMapped, imagename)
+		}
+	}
+
+	d.m.Lock()
+	for mount := range d.volumes {
+		delete(d.volumes, mount)
+	}
+	for mount, vol := range volumes {
+		d.volumes[mount] = vol
+	}
+	d.saveState()
+	d.m.Unlock()
+
+	return report, nil
+}
+
+// sameDevice checks a mount source against a mapping, which may show either
+// the /dev/rbdX device or the udev /dev/rbd/<pool>/<image> symlink
+func (d *cephRBDVolumeDriver) sameDevice(source string, m rbdMapping) bool {
+	if source == m.Device || source == fmt.Sprintf("/dev/rbd/%s/%s", m.Pool, m.Image) {
+		return true
+	}
+	resolved, err := filepath.EvalSymlinks(source)
+	return err == nil && resolved == m.Device
+}
+
+// adoptedLockMode tells how an image mapped here, but missing from our state,
+// is locked: advisory if this plugin instance holds an rbd lock on it (or
+// nothing tells otherwise), exclusive if the kernel client holds the managed
+// lock of an image with the exclusive-lock feature. Returns the mode and the
+// cookie of the lock, if found.
+func (d *cephRBDVolumeDriver) adoptedLockMode(pool, name string) (string, string) {
+	locks, err := d.rbdLockList(pool, name)
+	if err != nil {
+		log.Printf("WARN: reconcile: unable to list locks of %s/%s, assuming advisory lock: %s", pool, name, err)
+		return lockModeAdvisory, ""
+	}
+	for _, lock := range locks {
+		if d.cookie.sameInstance(parseLockCookie(lock.ID)) {
+			return lockModeAdvisory, lock.ID
+		}
+	}
+	for _, lock := range locks {
+		if !strings.HasPrefix(lock.ID, exclusiveLockCookiePrefix) {
+			continue
+		}
+		info, err := d.rbdImageInfo(pool, name)
+		if err != nil {
+			log.Printf("WARN: reconcile: unable to get features of %s/%s, assuming advisory lock: %s", pool, name, err)
+			return lockModeAdvisory, ""
+		}
+		if contains(info.Features, "exclusive-lock") {
+			return lockModeExclusive, lock.ID
+		}
+	}
+	return lockModeAdvisory, ""
+}
+
+// rbdImageLockedBy returns the cookie of our lock on the image: the lock with
+// the given cookie or, if that is empty, one taken by this plugin instance
+// (possibly under an older hostname). Empty if we don't hold a lock.
+func (d *cephRBDVolumeDriver) rbdImageLockedBy(pool, name, cookie string) (string, error) {
+	locks, err := d.rbdLockList(pool, name)
+	if err != nil {
+		return "", err
+	}
+	for _, lock := range locks {
+		if cookie != "" && lock.ID == cookie {
+			return lock.ID, nil
+		}
+		if cookie == "" && d.cookie.sameInstance(parseLockCookie(lock.ID)) {
+			return lock.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// parseMountInfo parses /proc/self/mountinfo (see proc(5)):
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// optional fields end at the "-" separator, followed by fstype and source
+func parseMountInfo(data string) []mountInfo {
+	result := []mountInfo{}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 {
+			continue
+		}
+		// separator comes after the 6 fixed fields and optional fields
+		sep := indexOf(fields[6:], "-") + 6
+		if sep < 6 || len(fields) < sep+3 {
+			continue
+		}
+		result = append(result, mountInfo{
+			MountPoint: unescapeMountInfo(fields[4]),
+			FStype:     fields[sep+1],
+			Source:     unescapeMountInfo(fields[sep+2]),
+		})
+	}
+	return result
+}
+
+// unescapeMountInfo decodes the octal escapes (e.g. \040 for space) used in mountinfo paths
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func indexOf(vals []string, check string) int {
+	for i, v := range vals {
+		if v == check {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,21 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	data := `22 1 253:0 / / rw,relatime shared:1 - xfs /dev/mapper/root rw,attr2
+36 22 252:0 / /var/lib/docker/volumes/rbd/rbd/foo rw,relatime shared:20 - xfs /dev/rbd0 rw,attr2,inode64
+37 22 252:16 / /var/lib/docker/volumes/rbd/rbd/with\040space rw,relatime - ext4 /dev/rbd1 rw
+`
+	mounts := parseMountInfo(data)
+	assert.Equal(t, 3, len(mounts))
+	assert.Equal(t, mountInfo{MountPoint: "/var/lib/docker/volumes/rbd/rbd/foo", FStype: "xfs", Source: "/dev/rbd0"}, mounts[1])
+	assert.Equal(t, mountInfo{MountPoint: "/var/lib/docker/volumes/rbd/rbd/with space", FStype: "ext4", Source: "/dev/rbd1"}, mounts[2])
+}
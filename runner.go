@@ -0,0 +1,29 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// commandRunner runs the external commands the driver depends on (rbd,
+// mount, umount, blkid, xfs_repair, mkfs.*), so tests can swap in a fake
+type commandRunner interface {
+	// Run calls the named command until it exits or ctx is done, and returns its trimmed output
+	Run(ctx context.Context, name string, args ...string) (string, error)
+	// LookPath searches for the named executable
+	LookPath(file string) (string, error)
+}
+
+// shRunner is the real commandRunner, using the shell utils
+type shRunner struct{}
+
+func (shRunner) Run(ctx context.Context, name string, args ...string) (string, error) {
+	return shWithContext(ctx, name, args...)
+}
+
+func (shRunner) LookPath(file string) (string, error) {
+	return exec.LookPath(file)
+}
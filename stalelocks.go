@@ -0,0 +1,349 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Breaking stale image locks (opt-in with --break-stale-locks).
+//
+// A host that dies keeps its advisory lock forever. A lock is stale if the
+// holder has no watchers on the image (i.e. its host has nothing mapped or
+// open) and either its heartbeat lease expired, or - for holders without a
+// heartbeat, like older plugin versions - it had no watchers for the whole
+// --stale-lock-grace period. Mount then fences the holder's kernel client
+// with `ceph osd blocklist add` and removes its lock. Each break is appended to
+// the lock audit log as one JSON object per line.
+//
+// Locks of this host are never fenced: a lock left by a previous boot is just
+// removed (its clients died with it), any other is refused.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// staleLocks remembers since when lock holders were seen without watchers,
+// and the last watcher seen of their host
+type staleLocks struct {
+	m        sync.Mutex
+	seen     map[string]time.Time // key: pool/image/cookie
+	watchers map[string]string    // same key, watcher address
+}
+
+func newStaleLocks() *staleLocks {
+	return &staleLocks{seen: map[string]time.Time{}, watchers: map[string]string{}}
+}
+
+// inUse records the holder was seen alive with a watcher, the kernel client
+// to fence should it die
+func (s *staleLocks) inUse(key, watcher string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.seen, key)
+	s.watchers[key] = watcher
+}
+
+// lastWatcher returns the watcher address of the holder seen last, if any
+func (s *staleLocks) lastWatcher(key string) string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.watchers[key]
+}
+
+// noWatchers records that the holder has no watchers now, and returns since
+// when it has had none
+func (s *staleLocks) noWatchers(key string, now time.Time) time.Time {
+	s.m.Lock()
+	defer s.m.Unlock()
+	since, ok := s.seen[key]
+	if !ok {
+		s.seen[key] = now
+		return now
+	}
+	return since
+}
+
+// forget drops the holder, e.g. when it was seen alive again
+func (s *staleLocks) forget(key string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.seen, key)
+	delete(s.watchers, key)
+}
+
+// lockAuditEntry is one line of the lock audit log
+type lockAuditEntry struct {
+	Time          time.Time    `json:"time"`
+	Action        string       `json:"action"`
+	Pool          string       `json:"pool"`
+	Image         string       `json:"image"`
+	Lock          rbdLock      `json:"lock"`
+	Holder        string       `json:"holder"`
+	Watchers      []rbdWatcher `json:"watchers"`
+	NoWatchersFor string       `json:"no_watchers_for"`
+	Lease         string       `json:"lease"`
+	BrokenBy      string       `json:"broken_by"`
+	Fenced        string       `json:"fenced"` // blocklisted kernel client address, empty if none
+	Error         string       `json:"error,omitempty"`
+}
+
+// tryLockImage is lockImage, but if the image is locked by another host and
+// --break-stale-locks is on, a stale lock is broken and locking tried again
+func (d *cephRBDVolumeDriver) tryLockImage(pool, imagename string) (string, error) {
+	locker, err := d.lockImage(pool, imagename)
+	if err == nil || !isExitCode(err, syscall.EBUSY) || !*breakStaleLocks {
+		return locker, err
+	}
+	broken, berr := d.breakStaleLock(pool, imagename)
+	if berr != nil {
+		log.Printf("WARN: unable to break stale lock on %s/%s: %s", pool, imagename, berr)
+	}
+	if !broken {
+		return "", err
+	}
+	return d.lockImage(pool, imagename)
+}
+
+// breakStaleLock removes the lock of another host if it has had no watchers
+// for the grace period, after fencing the holder's kernel client. Returns true
+// if the image is no longer locked.
+func (d *cephRBDVolumeDriver) breakStaleLock(pool, name string) (bool, error) {
+	locks, err := d.rbdLockList(pool, name)
+	if err != nil {
+		return false, err
+	}
+	if len(locks) == 0 {
+		return true, nil
+	}
+	if len(locks) > 1 {
+		return false, fmt.Errorf("not breaking %d locks on %s/%s: %s", len(locks), pool, name, formatLockHolders(locks))
+	}
+	lock := locks[0]
+	holder := parseLockCookie(lock.ID)
+	if d.cookie.sameInstance(holder) {
+		// ours: nothing stale about it, the caller needs to sort it out
+		return false, nil
+	}
+	ownHost, err := d.isOwnHost(holder, lock.Address)
+	if err != nil {
+		return false, err
+	}
+	if ownHost {
+		if d.cookie.previousBoot(holder) {
+			return d.removePreviousBootLock(pool, name, lock)
+		}
+		// fencing would cut off our own kernel clients
+		return false, fmt.Errorf("not breaking lock on %s/%s: holder %s is this host", pool, name, describeLock(lock))
+	}
+
+	watchers, err := d.rbdWatchers(pool, name)
+	if err != nil {
+		return false, err
+	}
+	key := pool + "/" + name + "/" + lock.ID
+	for _, w := range watchers {
+		if addressHost(w.Address) == addressHost(lock.Address) {
+			d.staleLocks.inUse(key, w.Address)
+			log.Printf("INFO: lock on %s/%s is in use: holder %s has a watcher", pool, name, describeLock(lock))
+			return false, nil
+		}
+	}
+
+	now := time.Now()
+	since := d.staleLocks.noWatchers(key, now)
+	hb, err := d.imageHeartbeat(pool, name, lock.ID)
+	if err != nil {
+		// fall back to the grace period
+		log.Printf("WARN: unable to get heartbeat of %s/%s: %s", pool, name, err)
+	}
+	lease := "no heartbeat"
+	if hb != nil {
+		lease = hb.describe(now)
+		if !hb.expired(now) {
+			log.Printf("INFO: lock on %s/%s is in use: holder %s has no watchers, but its %s", pool, name, describeLock(lock), lease)
+			return false, nil
+		}
+	} else if now.Sub(since) < *staleLockGrace {
+		log.Printf("INFO: lock on %s/%s looks stale: holder %s has had no watchers for %s, breaking it after %s",
+			pool, name, describeLock(lock), now.Sub(since), *staleLockGrace)
+		return false, nil
+	}
+
+	// fence the kernel client still mapping the image, not the whole host
+	fence := d.staleLocks.lastWatcher(key)
+	if hb != nil && hb.Client != "" {
+		fence = hb.Client
+	}
+	if fence == "" {
+		return false, fmt.Errorf("not breaking lock on %s/%s: no kernel client of holder %s known to fence, "+
+			"blocklist it and remove the lock by hand (rbd lock rm %s/%s '%s' %s)",
+			pool, name, describeLock(lock), pool, name, lock.ID, lock.Locker)
+	}
+
+	entry := lockAuditEntry{
+		Time:          now,
+		Action:        "break",
+		Pool:          pool,
+		Image:         name,
+		Lock:          lock,
+		Holder:        describeLock(lock),
+		Watchers:      watchers,
+		NoWatchersFor: now.Sub(since).String(),
+		Lease:         lease,
+		BrokenBy:      d.cookie.describe(),
+		Fenced:        fence,
+	}
+	log.Printf("WARN: breaking stale lock on %s/%s: holder %s has had no watchers for %s, %s", pool, name, entry.Holder, entry.NoWatchersFor, lease)
+
+	// fence first: the old holder must not write to the image once we took over
+	err = d.blocklistClient(entry.Fenced)
+	if err == nil {
+		_, err = d.rbdsh(pool, "lock", "rm", name, lock.ID, lock.Locker)
+	}
+	if err != nil {
+		entry.Action = "break-failed"
+		entry.Error = err.Error()
+		d.auditLock(entry)
+		return false, err
+	}
+	d.auditLock(entry)
+	d.staleLocks.forget(key)
+	return true, nil
+}
+
+// removePreviousBootLock removes a lock this host took before it rebooted.
+// Nothing to fence: the kernel clients of that boot are gone.
+func (d *cephRBDVolumeDriver) removePreviousBootLock(pool, name string, lock rbdLock) (bool, error) {
+	entry := lockAuditEntry{
+		Time:     time.Now(),
+		Action:   "remove-previous-boot",
+		Pool:     pool,
+		Image:    name,
+		Lock:     lock,
+		Holder:   describeLock(lock),
+		BrokenBy: d.cookie.describe(),
+	}
+	log.Printf("WARN: removing lock on %s/%s left by a previous boot of this host: %s", pool, name, entry.Holder)
+	_, err := d.rbdsh(pool, "lock", "rm", name, lock.ID, lock.Locker)
+	if err != nil {
+		entry.Action = "remove-failed"
+		entry.Error = err.Error()
+		d.auditLock(entry)
+		return false, err
+	}
+	d.auditLock(entry)
+	return true, nil
+}
+
+// isOwnHost tells if a lock holder is this host: same machine ID, or the lock
+// was taken from one of our addresses
+func (d *cephRBDVolumeDriver) isOwnHost(holder lockCookie, lockAddress string) (bool, error) {
+	if holder.MachineID != "" && holder.MachineID == d.cookie.MachineID {
+		return true, nil
+	}
+	addrs, err := d.localAddrs()
+	if err != nil {
+		return false, fmt.Errorf("unable to list local addresses: %s", err)
+	}
+	return indexOf(addrs, addressHost(lockAddress)) >= 0, nil
+}
+
+// kernelClient returns the address of our kernel client watching the image,
+// what another host fences should our lease expire. Empty if not found.
+func (d *cephRBDVolumeDriver) kernelClient(pool, name string) string {
+	watchers, err := d.rbdWatchers(pool, name)
+	if err != nil {
+		log.Printf("WARN: unable to get watchers of %s/%s: %s", pool, name, err)
+		return ""
+	}
+	addrs, err := d.localAddrs()
+	if err != nil {
+		log.Printf("WARN: unable to list local addresses: %s", err)
+		return ""
+	}
+	client := ""
+	for _, w := range watchers {
+		if indexOf(addrs, addressHost(w.Address)) < 0 {
+			continue
+		}
+		if client != "" {
+			log.Printf("WARN: %s/%s has more than one watcher on this host, not telling which to fence", pool, name)
+			return ""
+		}
+		client = w.Address
+	}
+	return client
+}
+
+// localHostAddresses returns the IP addresses of this host
+func localHostAddresses() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := []string{}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP.String())
+		}
+	}
+	return ips, nil
+}
+
+// blocklistClient fences a ceph client, so it can't write to the cluster
+// anymore
+func (d *cephRBDVolumeDriver) blocklistClient(address string) error {
+	_, err := d.cephsh("osd", "blocklist", "add", address)
+	if err != nil {
+		// before pacific it was called blacklist
+		if _, oldErr := d.cephsh("osd", "blacklist", "add", address); oldErr == nil {
+			return nil
+		}
+		return fmt.Errorf("Unable to blocklist client %s: %s", address, err)
+	}
+	return nil
+}
+
+// auditLock appends an entry to the lock audit log
+func (d *cephRBDVolumeDriver) auditLock(entry lockAuditEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("ERROR: unable to encode lock audit entry: %s", err)
+		return
+	}
+	log.Printf("INFO: lock audit: %s", data)
+	if d.lockAuditLog == "" {
+		return
+	}
+	f, err := os.OpenFile(d.lockAuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("ERROR: unable to open lock audit log %s: %s", d.lockAuditLog, err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		log.Printf("ERROR: unable to write lock audit log %s: %s", d.lockAuditLog, err)
+	}
+}
+
+// addressHost returns the host part of a ceph client address, e.g. 10.0.0.5
+// for 10.0.0.5:0/1234. The lock is taken by the short lived rbd command, the
+// watcher is the kernel client of the same host, so only the host matches.
+func addressHost(address string) string {
+	address = strings.TrimPrefix(strings.TrimPrefix(address, "v1:"), "v2:")
+	if i := strings.LastIndex(address, "/"); i >= 0 {
+		address = address[:i]
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
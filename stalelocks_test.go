@@ -0,0 +1,182 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stretchr/testify/assert"
+)
+
+// setStaleLockFlags turns on stale lock breaking, returns a func restoring the flags
+func setStaleLockFlags(grace time.Duration) func() {
+	origBreak, origGrace := *breakStaleLocks, *staleLockGrace
+	*breakStaleLocks, *staleLockGrace = true, grace
+	return func() { *breakStaleLocks, *staleLockGrace = origBreak, origGrace }
+}
+
+func TestMount_breakStaleLock(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer setStaleLockFlags(0)()
+	d.lockAuditLog = filepath.Join(filepath.Dir(d.stateFile), "lock-audit.log")
+
+	// holder seen alive first, then its host dies: lock left, nothing mapped
+	img := fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected Mount to fail on lock in use")
+	img.watchers = nil
+
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, []string{"10.0.0.9:0/3524101"}, fake.blocklist, "Expected old holder's kernel client to be fenced")
+	if assert.Equal(t, 1, len(fake.image("rbd", "foo").locks)) {
+		assert.Equal(t, fake.client, fake.image("rbd", "foo").locks[0].Locker, "Expected us to hold the lock")
+	}
+
+	data, err := ioutil.ReadFile(d.lockAuditLog)
+	assert.Nil(t, err, formatError("ReadFile", err))
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Equal(t, 1, len(lines)) {
+		entry := lockAuditEntry{}
+		assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+		assert.Equal(t, "break", entry.Action)
+		assert.Equal(t, "rbd", entry.Pool)
+		assert.Equal(t, "foo", entry.Image)
+		assert.Equal(t, rbdLock{ID: "otherhost", Locker: "client.9999", Address: "10.0.0.9:0/9999"}, entry.Lock)
+		assert.Equal(t, d.cookie.describe(), entry.BrokenBy)
+		assert.Equal(t, "10.0.0.9:0/3524101", entry.Fenced)
+	}
+}
+
+func TestMount_breakStaleLock_blacklist(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer setStaleLockFlags(0)()
+	fake.noBlocklist = true
+
+	img := fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+	fake.heartbeatFromOtherHost("rbd", "foo", "otherhost", time.Now().Add(-time.Minute))
+	img.watchers = nil
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, []string{"10.0.0.9:0/3524101"}, fake.blocklist, "Expected old holder's kernel client to be fenced")
+}
+
+func TestMount_staleLockNoClientKnown(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer setStaleLockFlags(0)()
+
+	// never seen alive, no heartbeat: nothing precise to fence
+	img := fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+	img.watchers = nil
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected Mount to fail without a client to fence")
+	assert.Equal(t, 0, len(fake.blocklist), "Expected nobody to be fenced")
+	assert.Equal(t, "otherhost", fake.image("rbd", "foo").locks[0].ID)
+}
+
+func TestMount_staleLockPreviousBoot(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer setStaleLockFlags(time.Hour)()
+	d.cookie.MachineID, d.cookie.BootID = "m1", "boot2"
+
+	// left by this host before it rebooted, from an address it no longer has
+	img := fake.addImage("rbd", "foo", "xfs")
+	old := lockCookie{Host: d.cookie.Host, MachineID: "m1", BootID: "boot1", Plugin: "test"}
+	img.locks = []rbdLock{{Locker: "client.3333", ID: old.String(), Address: "10.0.0.7:0/3333"}}
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, 0, len(fake.blocklist), "Expected nothing fenced for our own previous boot")
+	if assert.Equal(t, 1, len(fake.image("rbd", "foo").locks)) {
+		assert.Equal(t, fake.client, fake.image("rbd", "foo").locks[0].Locker, "Expected us to hold the lock")
+	}
+}
+
+func TestMount_staleLockOwnHost(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer setStaleLockFlags(0)()
+
+	// another plugin (or an older version) on this host: never fence ourselves
+	img := fake.addImage("rbd", "foo", "xfs")
+	img.locks = []rbdLock{{Locker: "client.3333", ID: "someone", Address: "10.0.0.5:0/3333"}}
+	fake.heartbeatFromOtherHost("rbd", "foo", "someone", time.Now().Add(-time.Minute))
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected Mount to fail on a lock of this host")
+	assert.Equal(t, 0, len(fake.blocklist), "Expected nobody to be fenced")
+	assert.Equal(t, "someone", fake.image("rbd", "foo").locks[0].ID)
+}
+
+func TestMount_staleLockWithWatcher(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer setStaleLockFlags(0)()
+
+	// holder host still has the image mapped
+	fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected Mount to fail on lock in use")
+	assert.Equal(t, 0, len(fake.blocklist), "Expected nobody to be fenced")
+	assert.Equal(t, "otherhost", fake.image("rbd", "foo").locks[0].ID)
+}
+
+func TestMount_staleLockGrace(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+	defer setStaleLockFlags(100 * time.Millisecond)()
+
+	img := fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected Mount to fail on lock in use")
+	img.watchers = nil
+
+	// first seen without watchers: not broken yet
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected Mount to fail within grace period")
+	assert.Equal(t, 0, len(fake.blocklist), "Expected nobody to be fenced yet")
+
+	time.Sleep(150 * time.Millisecond)
+	_, err = d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.Nil(t, err, formatError("Mount", err))
+	assert.Equal(t, []string{"10.0.0.9:0/3524101"}, fake.blocklist, "Expected old holder's last watcher to be fenced")
+}
+
+func TestMount_staleLockDisabled(t *testing.T) {
+	d, fake, cleanup := newFakeDriver(t)
+	defer cleanup()
+
+	img := fake.addImage("rbd", "foo", "xfs")
+	fake.lockFromOtherHost("rbd", "foo", "otherhost")
+	img.watchers = nil
+
+	_, err := d.Mount(&volume.MountRequest{Name: "foo", ID: "c1"})
+	assert.NotNil(t, err, "Expected Mount to fail without --break-stale-locks")
+	assert.Equal(t, 0, len(fake.blocklist), "Expected nobody to be fenced")
+}
+
+func TestAddressHost(t *testing.T) {
+	assert.Equal(t, "10.0.0.5", addressHost("10.0.0.5:0/1234"))
+	assert.Equal(t, "10.0.0.5", addressHost("v1:10.0.0.5:0/1234"))
+	assert.Equal(t, "fd00::5", addressHost("[fd00::5]:0/1234"))
+	assert.Equal(t, "garbage", addressHost("garbage"))
+}
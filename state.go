@@ -0,0 +1,154 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+// Persist the table of locally mounted volumes, so that a restarted (or
+// crashed) plugin still knows which devices it mapped, mounted and locked, and
+// which locks it still has to release.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// bump when the on-disk format changes incompatibly
+const stateFileVersion = 1
+
+// volumeState is the on-disk format of the state file
+type volumeState struct {
+	Version int
+	Volumes map[string]*Volume // keyed on mountpoint, same as driver.volumes
+	// unmounted and unmapped, but the lock release failed: same key, see
+	// driver.pendingUnlocks
+	PendingUnlocks map[string]*Volume `json:",omitempty"`
+}
+
+// loadVolumeState reads the volume tables from the state file. A missing file
+// is not an error, it just means nothing is mounted (e.g. first start).
+func loadVolumeState(path string) (volumeState, error) {
+	loaded := volumeState{Volumes: map[string]*Volume{}, PendingUnlocks: map[string]*Volume{}}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return loaded, nil
+		}
+		return loaded, err
+	}
+
+	state := volumeState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return loaded, fmt.Errorf("unable to parse state file %s: %s", path, err)
+	}
+	if state.Version != stateFileVersion {
+		return loaded, fmt.Errorf("unsupported state file version %d in %s", state.Version, path)
+	}
+
+	loaded.Version = state.Version
+	for mount, vol := range state.Volumes {
+		if vol != nil {
+			loaded.Volumes[mount] = vol
+		}
+	}
+	for mount, vol := range state.PendingUnlocks {
+		if vol != nil {
+			loaded.PendingUnlocks[mount] = vol
+		}
+	}
+	return loaded, nil
+}
+
+// saveVolumeState atomically replaces the state file with the given volume
+// tables: write a temp file in the same directory, fsync it, rename it over
+// the old file and fsync the directory so the rename itself is durable.
+func saveVolumeState(path string, state volumeState) error {
+	state.Version = stateFileVersion
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, os.ModeDir|os.FileMode(int(0755)))
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// no-op once the rename succeeded
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	// make the rename durable
+	dh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dh.Close()
+	return dh.Sync()
+}
+
+// loadState fills the driver volume table from the state file, if any
+func (d *cephRBDVolumeDriver) loadState() {
+	if d.stateFile == "" {
+		return
+	}
+	state, err := loadVolumeState(d.stateFile)
+	if err != nil {
+		// keep it for the operator, the next save would replace it
+		aside := fmt.Sprintf("%s.corrupt-%d", d.stateFile, time.Now().Unix())
+		if rerr := os.Rename(d.stateFile, aside); rerr != nil {
+			log.Printf("ERROR: unable to move unreadable state file aside: %s", rerr)
+		} else {
+			log.Printf("ERROR: moved unreadable state file to %s", aside)
+		}
+		log.Printf("ERROR: unable to load volume state, starting without known mounts: %s", err)
+		return
+	}
+	for mount, vol := range state.Volumes {
+		log.Printf("INFO: loaded volume state: %s/%s on %s (%s)", vol.Pool, vol.Name, vol.Device, mount)
+		d.volumes[mount] = vol
+	}
+	for mount, vol := range state.PendingUnlocks {
+		log.Printf("INFO: loaded volume state: %s/%s still to unlock", vol.Pool, vol.Name)
+		d.pendingUnlocks[mount] = vol
+	}
+}
+
+// saveState writes the current driver volume tables to the state file, caller
+// must hold d.m. Errors are only logged: the kernel state is already changed
+// by the time we get here, failing the API call would not undo it.
+func (d *cephRBDVolumeDriver) saveState() {
+	if d.stateFile == "" {
+		return
+	}
+	err := saveVolumeState(d.stateFile, volumeState{Volumes: d.volumes, PendingUnlocks: d.pendingUnlocks})
+	if err != nil {
+		log.Printf("ERROR: unable to save volume state to %s: %s", d.stateFile, err)
+	}
+}
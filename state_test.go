@@ -0,0 +1,120 @@
+// Copyright 2015 YP LLC.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeState_missingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-state")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+
+	state, err := loadVolumeState(filepath.Join(dir, "nope.json"))
+	assert.Nil(t, err, formatError("loadVolumeState", err))
+	assert.Equal(t, 0, len(state.Volumes), "Expected no volumes from missing state file")
+}
+
+func TestVolumeState_saveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-state")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+
+	// nested dir should be created on save
+	path := filepath.Join(dir, "sub", "volumes.json")
+	volumes := map[string]*Volume{
+		"/mnt/rbd/rbd/foo": {
+			Name:     "foo",
+			Device:   "/dev/rbd0",
+			Locker:   "host1",
+			FStype:   "xfs",
+			Pool:     "rbd",
+			MountIDs: []string{"abc123"},
+		},
+	}
+
+	pending := map[string]*Volume{
+		"/mnt/rbd/rbd/bar": {Name: "bar", Locker: "host1", Pool: "rbd"},
+	}
+
+	err = saveVolumeState(path, volumeState{Volumes: volumes, PendingUnlocks: pending})
+	assert.Nil(t, err, formatError("saveVolumeState", err))
+
+	loaded, err := loadVolumeState(path)
+	assert.Nil(t, err, formatError("loadVolumeState", err))
+	assert.Equal(t, volumes, loaded.Volumes, "Expected same volumes after reload")
+	assert.Equal(t, pending, loaded.PendingUnlocks, "Expected same pending unlocks after reload")
+
+	// overwrite with empty table - no temp files should be left behind
+	err = saveVolumeState(path, volumeState{Volumes: map[string]*Volume{}})
+	assert.Nil(t, err, formatError("saveVolumeState", err))
+	loaded, err = loadVolumeState(path)
+	assert.Nil(t, err, formatError("loadVolumeState", err))
+	assert.Equal(t, 0, len(loaded.Volumes), "Expected empty volumes after overwrite")
+	assert.Equal(t, 0, len(loaded.PendingUnlocks), "Expected no pending unlocks after overwrite")
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err, formatError("ReadDir", err))
+	assert.Equal(t, 1, len(files), "Expected only the state file in state dir")
+}
+
+func TestVolumeState_corruptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-state")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "volumes.json")
+	err = ioutil.WriteFile(path, []byte("{not json"), 0644)
+	assert.Nil(t, err, formatError("WriteFile", err))
+
+	_, err = loadVolumeState(path)
+	assert.NotNil(t, err, "Expected error for corrupt state file")
+}
+
+func TestDriverReloadsState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-state")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "volumes.json")
+	d := newCephRBDVolumeDriver("test", "", "admin", "rbd", dir, "", path)
+	mount := d.mountpoint("rbd", "foo")
+	d.setVolume(mount, &Volume{Name: "foo", Pool: "rbd", Device: "/dev/rbd3", MountIDs: []string{"abc"}})
+
+	// a "restarted" plugin should know about the mount
+	restarted := newCephRBDVolumeDriver("test", "", "admin", "rbd", dir, "", path)
+	vol, found := restarted.volumes[mount]
+	assert.True(t, found, "Expected volume to be reloaded from state")
+	if found {
+		assert.Equal(t, "/dev/rbd3", vol.Device)
+	}
+}
+
+func TestDriverMovesCorruptStateAside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-state")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "volumes.json")
+	err = ioutil.WriteFile(path, []byte(`{"Version":1,"Volumes":{"/mnt/rbd/rbd/foo":{"Name":"fo`), 0644)
+	assert.Nil(t, err, formatError("WriteFile", err))
+
+	d := newCephRBDVolumeDriver("test", "", "admin", "rbd", dir, "", path)
+	assert.Equal(t, 0, len(d.volumes))
+	d.setVolume(d.mountpoint("rbd", "bar"), &Volume{Name: "bar", Pool: "rbd"})
+
+	// the partly written file is kept for the operator, not overwritten
+	aside, err := filepath.Glob(path + ".corrupt-*")
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(aside), "Expected corrupt state file to be moved aside") {
+		data, _ := ioutil.ReadFile(aside[0])
+		assert.Contains(t, string(data), `"Name":"fo`)
+	}
+}
@@ -1,19 +1,21 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"os/exec"
 	"os/user"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 var (
 	defaultShellTimeout = 2 * 60 * time.Second
+	killWaitTimeout     = 10 * time.Second // how long to wait for a killed command to exit
 )
 
 // returns current user gid or 0
@@ -31,82 +33,142 @@ func currentGid() int {
 	return gid
 }
 
-// sh is a simple os.exec Command tool, returns trimmed string output
-func sh(name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
-	if isDebugEnabled() {
-		log.Printf("DEBUG: sh CMD: %q", cmd)
+// maximum STDERR kept in a CmdError - enough for the error message from rbd et al
+const maxStderrLength = 1024
+
+// CmdError is returned when a command ran, but failed
+type CmdError struct {
+	Command  string
+	ExitCode int    // -1 if killed by a signal
+	Stderr   string // trimmed
+	Duration time.Duration
+}
+
+func (e CmdError) Error() string {
+	msg := fmt.Sprintf("command exited %d after %s: %s", e.ExitCode, e.Duration, e.Command)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+// exitCode returns the exit code of a failed command, or -1 if err is not
+// from a command that ran and exited
+func exitCode(err error) int {
+	if cmdErr, ok := err.(CmdError); ok {
+		return cmdErr.ExitCode
 	}
-	// TODO: capture and output STDERR to logfile?
-	out, err := cmd.Output()
-	return strings.Trim(string(out), " \n"), err
+	return -1
+}
+
+// isExitCode checks for a failed command which exited with errno as status,
+// like rbd does (e.g. 2: ENOENT, 16: EBUSY)
+func isExitCode(err error, errno syscall.Errno) bool {
+	return exitCode(err) == int(errno)
 }
 
-// ShResult used for channel in timeout
-type ShResult struct {
-	Output string // STDOUT
-	Err    error  // go error, not STDERR
+// trimStderr cleans up STDERR for use in an error message: one line, capped
+// to maxStderrLength (keeping the end, where the actual error usually is)
+func trimStderr(stderr string) string {
+	stderr = strings.Join(strings.Fields(stderr), " ")
+	if len(stderr) > maxStderrLength {
+		stderr = "..." + stderr[len(stderr)-maxStderrLength:]
+	}
+	return stderr
 }
 
+// ShTimeoutError is returned when a command was killed because it ran out of
+// time (or its context was canceled)
 type ShTimeoutError struct {
-	timeout time.Duration
+	timeout      time.Duration // how long we waited before killing it
+	Command      string
+	Canceled     bool // context was canceled rather than reaching its deadline
+	StillRunning bool // process did not exit after SIGKILL (e.g. stuck in krbd)
 }
 
 func (e ShTimeoutError) Error() string {
-	return fmt.Sprintf("Reached TIMEOUT on shell command")
+	what := "Reached TIMEOUT"
+	if e.Canceled {
+		what = "Canceled"
+	}
+	msg := fmt.Sprintf("%s on shell command after %s: %s", what, e.timeout, e.Command)
+	if e.StillRunning {
+		return msg + " (process did not exit after kill, it may still take effect)"
+	}
+	return msg + " (killed, it may have partially taken effect)"
 }
 
-// shWithDefaultTimeout will use the defaultShellTimeout so you dont have to pass one
-func shWithDefaultTimeout(name string, args ...string) (string, error) {
-	return shWithTimeout(defaultShellTimeout, name, args...)
+// MayStillTakeEffect is true if the command may still change state after we
+// returned, i.e. it could not be killed
+func (e ShTimeoutError) MayStillTakeEffect() bool {
+	return e.StillRunning
 }
 
-// shWithTimeout will run the Cmd and wait for the specified duration
-func shWithTimeout(howLong time.Duration, name string, args ...string) (string, error) {
-	// duration can't be zero
-	if howLong <= 0 {
-		return "", fmt.Errorf("Timeout duration needs to be positive")
-	}
-	// set up the results channel
-	resultsChan := make(chan ShResult, 1)
+// shWithContext will run the Cmd until it exits or the context is done. In
+// the latter case the command's whole process group is killed, and we wait
+// (up to killWaitTimeout) for it to exit so it can't change state behind our
+// back later.
+func shWithContext(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	// own process group, so we can kill anything it forked too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 	if isDebugEnabled() {
-		log.Printf("DEBUG: shWithTimeout: %v, %s, %v", howLong, name, args)
+		deadline, _ := ctx.Deadline()
+		log.Printf("DEBUG: shWithContext: deadline=%v, CMD: %q", deadline, cmd.Args)
 	}
 
-	// fire up the goroutine for the actual shell command
+	started := time.Now()
+	err := cmd.Start()
+	if err != nil {
+		return "", err
+	}
+	done := make(chan error, 1)
 	go func() {
-		out, err := sh(name, args...)
-		resultsChan <- ShResult{Output: out, Err: err}
+		done <- cmd.Wait()
 	}()
 
 	select {
-	case res := <-resultsChan:
-		return res.Output, res.Err
-	case <-time.After(howLong):
-		return "", ShTimeoutError{timeout: howLong}
+	case err = <-done:
+		out := strings.Trim(stdout.String(), " \n")
+		if err == nil {
+			return out, nil
+		}
+		cmdErr := CmdError{
+			Command:  strings.Join(cmd.Args, " "),
+			ExitCode: -1,
+			Stderr:   trimStderr(stderr.String()),
+			Duration: time.Since(started).Round(time.Millisecond),
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+				cmdErr.ExitCode = status.ExitStatus()
+			}
+		}
+		log.Printf("WARN: %s", cmdErr)
+		return out, cmdErr
+	case <-ctx.Done():
 	}
 
-	return "", nil
-}
-
-// grepLines pulls out lines that match a string (no regex ... yet)
-func grepLines(data string, like string) []string {
-	var result = []string{}
-	if like == "" {
-		log.Printf("ERROR: unable to look for empty pattern")
-		return result
+	timeoutErr := ShTimeoutError{
+		timeout:  time.Since(started).Round(time.Millisecond),
+		Command:  strings.Join(cmd.Args, " "),
+		Canceled: ctx.Err() == context.Canceled,
 	}
-	like_bytes := []byte(like)
 
-	scanner := bufio.NewScanner(strings.NewReader(data))
-	for scanner.Scan() {
-		if bytes.Contains(scanner.Bytes(), like_bytes) {
-			result = append(result, scanner.Text())
-		}
-	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("WARN: error scanning string for %s: %s", like, err)
+	log.Printf("WARN: killing process group %d: %s", cmd.Process.Pid, timeoutErr.Command)
+	err = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	if err != nil {
+		log.Printf("WARN: unable to kill process group %d: %s", cmd.Process.Pid, err)
 	}
 
-	return result
+	select {
+	case <-done:
+	case <-time.After(killWaitTimeout):
+		log.Printf("ERROR: process group %d did not exit after kill: %s", cmd.Process.Pid, timeoutErr.Command)
+		timeoutErr.StillRunning = true
+	}
+	return "", timeoutErr
 }
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -8,17 +14,36 @@ import (
 )
 
 func TestSh_success(t *testing.T) {
-	out, err := sh("ls")
+	out, err := testDriver.sh("ls")
 	assert.Nil(t, err, formatError("ls", err))
 	assert.Contains(t, out, "driver_test.go")
 }
 
 func TestSh_fail(t *testing.T) {
-	_, err := sh("false")
+	_, err := testDriver.sh("false")
 	assert.NotNil(t, err, formatError("false", err))
+	assert.Equal(t, 1, exitCode(err), "Expected exit code 1")
 }
 
-func TestShWithDefaultTimeout_triggerDefaultTimeout(t *testing.T) {
+func TestSh_failStderr(t *testing.T) {
+	_, err := testDriver.sh("sh", "-c", "echo 'rbd: error opening image foo: (2) No such file or directory' >&2; exit 2")
+	cmdErr, ok := err.(CmdError)
+	if assert.True(t, ok, "Expected CmdError") {
+		assert.Equal(t, 2, cmdErr.ExitCode)
+		assert.Equal(t, "rbd: error opening image foo: (2) No such file or directory", cmdErr.Stderr)
+		assert.Contains(t, cmdErr.Command, "exit 2")
+	}
+	assert.Contains(t, err.Error(), "No such file or directory", "Expected stderr in error")
+	assert.True(t, isExitCode(err, syscall.ENOENT), "Expected ENOENT exit code")
+}
+
+func TestTrimStderr(t *testing.T) {
+	assert.Equal(t, "line one line two", trimStderr("  line one\nline two\n"))
+	long := trimStderr(strings.Repeat("x", 2*maxStderrLength))
+	assert.Equal(t, maxStderrLength+3, len(long), "Expected stderr to be capped")
+}
+
+func TestSh_triggerDefaultTimeout(t *testing.T) {
 	// reset this global for the tests
 	defaultShellTimeout = 2 * time.Second
 
@@ -26,7 +51,7 @@ func TestShWithDefaultTimeout_triggerDefaultTimeout(t *testing.T) {
 	sleepSecs := "4"
 
 	// use the default timeout - we want to trigger it
-	_, err := shWithDefaultTimeout("sleep", sleepSecs)
+	_, err := testDriver.sh("sleep", sleepSecs)
 	assert.NotNil(t, err, "Expected to get error for timeout")
 	assert.Contains(t, err.Error(), "Reached TIMEOUT", "Expected 'Reached TIMEOUT' error")
 
@@ -36,7 +61,7 @@ func TestShWithDefaultTimeout_triggerDefaultTimeout(t *testing.T) {
 
 func TestShWithTimeout_timeoutZeroFail(t *testing.T) {
 	// pass 0 as our duration to trigger the error
-	_, err := shWithTimeout(0, "sleep", "1")
+	_, err := testDriver.shWithTimeout(0, "sleep", "1")
 	assert.NotNil(t, err, "Expected to get error for duration")
 	assert.Contains(t, err.Error(), "duration needs to be positive", "Expected duration validation error")
 }
@@ -49,7 +74,7 @@ func TestShWithTimeout_cmdSucceeds(t *testing.T) {
 	timeout := 2 * time.Second
 
 	// pass timeout and cmd shorter than that
-	_, err := shWithTimeout(timeout, "sleep", sleepSecs)
+	_, err := testDriver.shWithTimeout(timeout, "sleep", sleepSecs)
 	assert.Nil(t, err, "Expected success for command, not timeout")
 }
 
@@ -61,7 +86,45 @@ func TestShWithTimeout_cmdTimesOut(t *testing.T) {
 	sleepSecs := "4"
 
 	// pass our timeout and long sleep
-	_, err := shWithTimeout(timeout, "sleep", sleepSecs)
+	_, err := testDriver.shWithTimeout(timeout, "sleep", sleepSecs)
 	assert.NotNil(t, err, "Expected to get error for timeout")
 	assert.Contains(t, err.Error(), "Reached TIMEOUT", "Expected 'Reached TIMEOUT' error")
 }
+
+func TestShWithTimeout_errorShowsCommand(t *testing.T) {
+	_, err := testDriver.shWithTimeout(500*time.Millisecond, "sleep", "4")
+	assert.NotNil(t, err, "Expected to get error for timeout")
+	assert.Contains(t, err.Error(), "after 500ms", "Expected timeout in error")
+	assert.Contains(t, err.Error(), "sleep 4", "Expected command in error")
+	timeoutErr, ok := err.(ShTimeoutError)
+	if assert.True(t, ok, "Expected ShTimeoutError") {
+		assert.False(t, timeoutErr.MayStillTakeEffect(), "Expected sleep to be killed")
+	}
+}
+
+func TestShWithTimeout_killsProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-sh")
+	assert.Nil(t, err, formatError("TempDir", err))
+	defer os.RemoveAll(dir)
+
+	// the forked child must die with the shell, or it would still touch the file
+	marker := filepath.Join(dir, "took-effect")
+	_, err = testDriver.shWithTimeout(500*time.Millisecond, "sh", "-c", "(sleep 1; touch "+marker+") & wait")
+	assert.NotNil(t, err, "Expected to get error for timeout")
+
+	time.Sleep(1500 * time.Millisecond)
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err), "Expected child process to be killed before it took effect")
+}
+
+func TestShWithContext_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := shWithContext(ctx, "sleep", "4")
+	assert.NotNil(t, err, "Expected to get error for cancel")
+	assert.Contains(t, err.Error(), "Canceled", "Expected 'Canceled' error")
+}